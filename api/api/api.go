@@ -11,11 +11,21 @@ import (
 
 	"github.com/gorilla/mux"
 	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/MariusVanDerWijden/node-crawler-backend/metrics"
 )
 
 type Api struct {
 	db    *sql.DB
 	cache *lru.Cache
+
+	ingestToken string
+	ingest      Ingester
+
+	forkBlock    uint64
+	forkSchedule *forkSchedule
+	minVersions  map[string]minVersion
 }
 
 func New(sdb *sql.DB) *Api {
@@ -43,12 +53,28 @@ func (a *Api) dropCacheLoop() {
 
 func (a *Api) HandleRequests(wg *sync.WaitGroup) {
 	defer wg.Done()
+	fmt.Println("Start serving on port 4000")
+	http.ListenAndServe(":4000", a.Handler())
+}
+
+// Handler returns the router serving the api endpoints.
+func (a *Api) Handler() http.Handler {
 	router := mux.NewRouter().StrictSlash(true)
 	router.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) { rw.Write([]byte("Hello")) })
 	router.HandleFunc("/v1/dashboard", a.handleDashboard).Queries("filter", "{filter}")
 	router.HandleFunc("/v1/dashboard", a.handleDashboard)
-	fmt.Println("Start serving on port 4000")
-	http.ListenAndServe(":4000", router)
+	router.HandleFunc("/v1/ingest", a.handleIngest).Methods(http.MethodPost)
+	router.HandleFunc("/v1/nodes", a.handleNodes)
+	router.HandleFunc("/v1/nodes/{id}", a.handleNode)
+	router.HandleFunc("/v1/vantage-points", a.handleVantagePoints)
+	router.HandleFunc("/v1/timeseries", a.handleTimeseries)
+	router.HandleFunc("/v1/readiness", a.handleReadiness)
+	router.HandleFunc("/v1/export", a.handleExport)
+	router.HandleFunc("/v1/capabilities", a.handleCapabilities)
+	router.HandleFunc("/v1/latency", a.handleLatency)
+	router.Handle("/metrics", promhttp.Handler())
+	router.Use(instrument)
+	return router
 }
 
 type client struct {
@@ -126,13 +152,17 @@ type result struct {
 	OperatingSystems []client `json:"operatingSystems"`
 	Versions         []client `json:"versions"`
 	Countries	 []client `json:"countries"`
+	Errors           []client `json:"errors"`
+	Disconnects      []client `json:"disconnects"`
 }
 
 func (a *Api) cachedOrQuery(prefix, query string, whereArgs []interface{}) []client {
 	var result []client
 	if cl, ok := a.cache.Get(prefix + toQuery(query, whereArgs)); ok {
+		metrics.CacheRequests.WithLabelValues("hit").Inc()
 		result = cl.([]client)
 	} else {
+		metrics.CacheRequests.WithLabelValues("miss").Inc()
 		var err error
 		result, err = clientQuery(a.db, query, whereArgs...)
 		if err != nil {
@@ -155,12 +185,14 @@ func toQuery(query string, whereArgs []interface{}) string {
 	return res
 }
 
-func (a *Api) storeCache(clientQuery, languageQuery, osQuery, countryQuery, versionQuery string, whereArgs []interface{}, r result) {
+func (a *Api) storeCache(clientQuery, languageQuery, osQuery, countryQuery, versionQuery, errorQuery, disconnectQuery string, whereArgs []interface{}, r result) {
 	a.cache.Add("c"+toQuery(clientQuery, whereArgs), r.Clients)
 	a.cache.Add("l"+toQuery(languageQuery, whereArgs), r.Languages)
 	a.cache.Add("o"+toQuery(osQuery, whereArgs), r.OperatingSystems)
 	a.cache.Add("v"+toQuery(versionQuery, whereArgs), r.Versions)
 	a.cache.Add("co"+toQuery(versionQuery, whereArgs), r.Countries)
+	a.cache.Add("e"+toQuery(errorQuery, whereArgs), r.Errors)
+	a.cache.Add("d"+toQuery(disconnectQuery, whereArgs), r.Disconnects)
 }
 
 func (a *Api) handleDashboard(rw http.ResponseWriter, r *http.Request) {
@@ -192,18 +224,24 @@ func (a *Api) handleDashboard(rw http.ResponseWriter, r *http.Request) {
 	topOsQuery := fmt.Sprintf("SELECT os_name as Name, COUNT(os_name) as Count FROM nodes %v GROUP BY os_name ORDER BY count DESC", where)
 	topVersionQuery := fmt.Sprintf("SELECT Name, Count(*) as Count FROM (SELECT version_major || '.' || version_minor || '.' || version_patch as Name FROM nodes %v) GROUP BY Name ORDER BY Count DESC ", where)
 	topCountriesQuery := fmt.Sprintf("SELECT country_name as Name, COUNT(country_name) as Count FROM nodes %v GROUP BY country_name ORDER BY count DESC", where)
+	topErrorsQuery := fmt.Sprintf("SELECT IFNULL(error_reason, 0) as Name, COUNT(*) as Count FROM nodes %v GROUP BY IFNULL(error_reason, 0) ORDER BY count DESC", where)
+	topDisconnectsQuery := fmt.Sprintf("SELECT IFNULL(disconnect_reason, -1) as Name, COUNT(*) as Count FROM nodes %v GROUP BY IFNULL(disconnect_reason, -1) ORDER BY count DESC", where)
 
 	clients := a.cachedOrQuery("c", topClientsQuery, whereArgs)
 	language := a.cachedOrQuery("l", topLanguageQuery, whereArgs)
 	operatingSystems := a.cachedOrQuery("o", topOsQuery, whereArgs)
 	countries := a.cachedOrQuery("co", topCountriesQuery, whereArgs)
+	errors := a.cachedOrQuery("e", topErrorsQuery, whereArgs)
+	disconnects := a.cachedOrQuery("d", topDisconnectsQuery, whereArgs)
 	var versions []client
 	if nameCountInQuery == 1 {
 		versions = a.cachedOrQuery("v", topVersionQuery, whereArgs)
 	}
 
-	res := result{Clients: clients, Languages: language, OperatingSystems: operatingSystems, Versions: versions, Countries: countries}
-	a.storeCache(topClientsQuery, topLanguageQuery, topOsQuery, topCountriesQuery, topVersionQuery, whereArgs, res)
+	res := result{Clients: clients, Languages: language, OperatingSystems: operatingSystems, Versions: versions, Countries: countries, Errors: errors, Disconnects: disconnects}
+	a.storeCache(topClientsQuery, topLanguageQuery, topOsQuery, topCountriesQuery, topVersionQuery, topErrorsQuery, topDisconnectsQuery, whereArgs, res)
+	res.Errors = namedErrors(errors)
+	res.Disconnects = namedDisconnects(disconnects)
 	json.NewEncoder(rw).Encode(res)
 }
 
@@ -226,19 +264,25 @@ func clientQuery(db *sql.DB, query string, args ...interface{}) ([]client, error
 
 func validateKey(key string) bool {
 	validKeys := map[string]struct{}{
-		"id":               {},
-		"name":             {},
-		"version_major":    {},
-		"version_minor":    {},
-		"version_patch":    {},
-		"version_tag":      {},
-		"version_build":    {},
-		"version_date":     {},
-		"os_name":          {},
-		"os_architecture":  {},
-		"language_name":    {},
-		"language_version": {},
+		"id":                {},
+		"name":              {},
+		"version_major":     {},
+		"version_minor":     {},
+		"version_patch":     {},
+		"version_tag":       {},
+		"version_build":     {},
+		"version_date":      {},
+		"os_name":           {},
+		"os_architecture":   {},
+		"language_name":     {},
+		"language_version":  {},
 		"country": {},
+		"fork_hash":         {},
+		"fork_next":         {},
+		"error_reason":      {},
+		"disconnect_reason": {},
+		"eth_version":       {},
+		"opera_version":     {},
 	}
 	_, ok := validKeys[key]
 	return ok
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// capabilityMatrix counts the nodes by the protocols they announce in their
+// Hello message and by the versions the crawler negotiated with them.
+type capabilityMatrix struct {
+	Nodes        int                  `json:"nodes"` // nodes with known capabilities
+	Capabilities []capabilityCount    `json:"capabilities"`
+	Negotiated   []capabilityCount    `json:"negotiated"`
+	Clients      []clientCapabilities `json:"clients"`
+}
+
+type capabilityCount struct {
+	Name  string `json:"name"`
+	Nodes int    `json:"nodes"`
+}
+
+type clientCapabilities struct {
+	Name         string         `json:"name"`
+	Nodes        int            `json:"nodes"`
+	Capabilities map[string]int `json:"capabilities"`
+}
+
+// handleCapabilities returns the capability matrix of the nodes matching the
+// filter, e.g. to see which clients still serve les or eth/66.
+func (a *Api) handleCapabilities(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Cache-Control", "max-age=600")
+
+	where, args, err := addFilterArgs(map[string]string{"filter": r.URL.Query().Get("filter")})
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("invalid filter: %v", err), http.StatusBadRequest)
+		return
+	}
+	if args != nil {
+		where = "WHERE " + where
+	}
+
+	rows, err := a.db.Query(fmt.Sprintf(`SELECT IFNULL(name, ''), d.capabilities,
+		IFNULL(eth_version, 0), IFNULL(opera_version, 0)
+		FROM (SELECT * FROM nodes %v) AS n JOIN node_details AS d ON n.ID = d.ID
+		WHERE IFNULL(d.capabilities, '') != ''`, where), args...)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(rw, "query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var (
+		matrix     capabilityMatrix
+		caps       = make(map[string]int)
+		negotiated = make(map[string]int)
+		clients    = make(map[string]*clientCapabilities)
+	)
+	for rows.Next() {
+		var (
+			name, capabilities string
+			eth, opera         int
+		)
+		if err := rows.Scan(&name, &capabilities, &eth, &opera); err != nil {
+			fmt.Println(err)
+			http.Error(rw, "query failed", http.StatusInternalServerError)
+			return
+		}
+		cl, ok := clients[name]
+		if !ok {
+			cl = &clientCapabilities{Name: name, Capabilities: make(map[string]int)}
+			clients[name] = cl
+		}
+		matrix.Nodes++
+		cl.Nodes++
+		for _, c := range strings.Split(capabilities, ",") {
+			caps[c]++
+			cl.Capabilities[c]++
+		}
+		if eth > 0 {
+			negotiated["eth/"+strconv.Itoa(eth)]++
+		}
+		if opera > 0 {
+			negotiated["opera/"+strconv.Itoa(opera)]++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Println(err)
+		http.Error(rw, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	matrix.Capabilities = sortedCapabilities(caps)
+	matrix.Negotiated = sortedCapabilities(negotiated)
+	matrix.Clients = make([]clientCapabilities, 0, len(clients))
+	for _, cl := range clients {
+		matrix.Clients = append(matrix.Clients, *cl)
+	}
+	sort.Slice(matrix.Clients, func(i, j int) bool {
+		if matrix.Clients[i].Nodes != matrix.Clients[j].Nodes {
+			return matrix.Clients[i].Nodes > matrix.Clients[j].Nodes
+		}
+		return matrix.Clients[i].Name < matrix.Clients[j].Name
+	})
+	json.NewEncoder(rw).Encode(matrix)
+}
+
+// sortedCapabilities orders the counts by protocol name and version, e.g.
+// eth/66 before eth/67 before les/2.
+func sortedCapabilities(counts map[string]int) []capabilityCount {
+	sorted := make([]capabilityCount, 0, len(counts))
+	for name, nodes := range counts {
+		sorted = append(sorted, capabilityCount{Name: name, Nodes: nodes})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		pi, vi := splitCapability(sorted[i].Name)
+		pj, vj := splitCapability(sorted[j].Name)
+		if pi != pj {
+			return pi < pj
+		}
+		if vi != vj {
+			return vi < vj
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// splitCapability splits a capability like "eth/66" into protocol and version.
+func splitCapability(c string) (string, int) {
+	i := strings.LastIndex(c, "/")
+	if i < 0 {
+		return c, 0
+	}
+	version, _ := strconv.Atoi(c[i+1:])
+	return c[:i], version
+}
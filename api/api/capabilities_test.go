@@ -0,0 +1,19 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSortedCapabilities(t *testing.T) {
+	got := sortedCapabilities(map[string]int{
+		"opera/63": 3, "eth/68": 1, "eth/100": 1, "les/2": 2, "eth/66": 4, "diff/1": 1, "snap/1": 2,
+	})
+	want := []capabilityCount{
+		{"diff/1", 1}, {"eth/66", 4}, {"eth/68", 1}, {"eth/100", 1},
+		{"les/2", 2}, {"opera/63", 3}, {"snap/1", 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong order:\ngot  %v\nwant %v", got, want)
+	}
+}
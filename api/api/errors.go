@@ -0,0 +1,82 @@
+package api
+
+import "strconv"
+
+// errorClasses names the error reasons of failed probes, as classified by
+// the crawler.
+var errorClasses = map[int]string{
+	0:  "none",
+	-1: "unknown",
+	1:  "dial_refused",
+	2:  "dial_timeout",
+	3:  "handshake_failed",
+	4:  "too_many_peers",
+	5:  "useless_peer",
+	6:  "wrong_network",
+	7:  "protocol_mismatch",
+	8:  "decode_error",
+	9:  "status_timeout",
+	10: "hello_timeout",
+}
+
+// namedErrors replaces the error reasons of the dashboard counts with the
+// names of their classes.
+func namedErrors(counts []client) []client {
+	named := make([]client, len(counts))
+	for i, c := range counts {
+		named[i] = c
+		if reason, err := strconv.Atoi(c.Name); err == nil {
+			named[i].Name = errorClass(reason)
+		}
+	}
+	return named
+}
+
+func errorClass(reason int) string {
+	if name, ok := errorClasses[reason]; ok {
+		return name
+	}
+	return "code_" + strconv.Itoa(reason)
+}
+
+// disconnectReasons names the p2p disconnect reasons sent by nodes which
+// ended the probe, in the style of the error classes.
+var disconnectReasons = map[int]string{
+	0:  "disconnect_requested",
+	1:  "network_error",
+	2:  "breach_of_protocol",
+	3:  "useless_peer",
+	4:  "too_many_peers",
+	5:  "already_connected",
+	6:  "incompatible_version",
+	7:  "invalid_identity",
+	8:  "client_quitting",
+	9:  "unexpected_identity",
+	10: "connected_to_self",
+	11: "read_timeout",
+	16: "subprotocol_error",
+}
+
+// namedDisconnects replaces the disconnect reasons of the dashboard counts
+// with their names, dropping the nodes which didn't disconnect.
+func namedDisconnects(counts []client) []client {
+	named := make([]client, 0, len(counts))
+	for _, c := range counts {
+		reason, err := strconv.Atoi(c.Name)
+		if err == nil && reason < 0 {
+			continue
+		}
+		if err == nil {
+			c.Name = disconnectReason(reason)
+		}
+		named = append(named, c)
+	}
+	return named
+}
+
+func disconnectReason(reason int) string {
+	if name, ok := disconnectReasons[reason]; ok {
+		return name
+	}
+	return "code_" + strconv.Itoa(reason)
+}
@@ -0,0 +1,31 @@
+package api
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestErrorNames(t *testing.T) {
+	snakeCase := regexp.MustCompile(`^[a-z0-9]+(_[a-z0-9]+)*$`)
+	for _, names := range []map[int]string{errorClasses, disconnectReasons} {
+		for reason, name := range names {
+			if !snakeCase.MatchString(name) {
+				t.Errorf("name %q of reason %d isn't snake_case", name, reason)
+			}
+		}
+	}
+}
+
+func TestNamedDisconnects(t *testing.T) {
+	counts := []client{{Name: "4", Count: 3}, {Name: "-1", Count: 10}, {Name: "3", Count: 2}, {Name: "99", Count: 1}}
+	want := []client{{Name: "too_many_peers", Count: 3}, {Name: "useless_peer", Count: 2}, {Name: "code_99", Count: 1}}
+	got := namedDisconnects(counts)
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got[i], want[i])
+		}
+	}
+}
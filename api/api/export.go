@@ -0,0 +1,205 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// exportFlushRows is the number of rows after which the export is flushed
+// to the client.
+const exportFlushRows = 1000
+
+// exportColumns are the columns of an export, in CSV order, named like the
+// keys of the JSON export and the other endpoints.
+var exportColumns = []string{
+	"id", "name", "version", "osName", "osArchitecture", "languageName", "languageVersion",
+	"country", "lastCrawled", "reachable", "latency", "vantagePoints", "forkHash", "forkNext",
+	"helloName", "ip", "tcp", "udp", "capabilities", "firstSeen", "lastSeen", "score",
+	"errorReason", "errorClass", "errorString", "disconnectReason",
+	"headNumber", "headTime", "headVerified", "blocksBehind", "ethVersion", "operaVersion",
+}
+
+// exportRow is a node in an export.
+type exportRow struct {
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	Version         string    `json:"version"`
+	OSName          string    `json:"osName"`
+	OSArchitecture  string    `json:"osArchitecture"`
+	LanguageName    string    `json:"languageName"`
+	LanguageVersion string    `json:"languageVersion"`
+	Country         string    `json:"country"`
+	LastCrawled     time.Time `json:"lastCrawled"`
+	Reachable       bool      `json:"reachable"`
+	Latency         *int64    `json:"latency"` // milliseconds
+	VantagePoints   int       `json:"vantagePoints"`
+	ForkHash        string    `json:"forkHash"`
+	ForkNext        uint64    `json:"forkNext"`
+	HelloName       string    `json:"helloName"`
+	IP              string    `json:"ip"`
+	TCP             int       `json:"tcp"`
+	UDP             int       `json:"udp"`
+	Capabilities    string    `json:"capabilities"`
+	FirstSeen       *int64    `json:"firstSeen"` // unix timestamp
+	LastSeen        *int64    `json:"lastSeen"`  // unix timestamp
+	Score           int       `json:"score"`
+	ErrorReason     int       `json:"errorReason"`
+	ErrorClass      string    `json:"errorClass"`
+	ErrorString     string    `json:"errorString"`
+	Disconnect      *int64    `json:"disconnectReason"`
+	HeadNumber      *int64    `json:"headNumber"`
+	HeadTime        *int64    `json:"headTime"` // unix timestamp
+	HeadVerified    bool      `json:"headVerified"`
+	BlocksBehind    *int64    `json:"blocksBehind"` // nil unless the head is verified
+	EthVersion      uint      `json:"ethVersion"`
+	OperaVersion    uint      `json:"operaVersion"`
+}
+
+func (r *exportRow) csvRecord() []string {
+	return []string{
+		r.ID, r.Name, r.Version, r.OSName, r.OSArchitecture, r.LanguageName, r.LanguageVersion,
+		r.Country, r.LastCrawled.UTC().Format(time.RFC3339), strconv.FormatBool(r.Reachable),
+		optionalInt(r.Latency), strconv.Itoa(r.VantagePoints), r.ForkHash, strconv.FormatUint(r.ForkNext, 10),
+		r.HelloName, r.IP, strconv.Itoa(r.TCP), strconv.Itoa(r.UDP), r.Capabilities,
+		optionalInt(r.FirstSeen), optionalInt(r.LastSeen), strconv.Itoa(r.Score),
+		strconv.Itoa(r.ErrorReason), r.ErrorClass, r.ErrorString, optionalInt(r.Disconnect),
+		optionalInt(r.HeadNumber), optionalInt(r.HeadTime), strconv.FormatBool(r.HeadVerified), optionalInt(r.BlocksBehind),
+		strconv.FormatUint(uint64(r.EthVersion), 10), strconv.FormatUint(uint64(r.OperaVersion), 10),
+	}
+}
+
+func optionalInt(i *int64) string {
+	if i == nil {
+		return ""
+	}
+	return strconv.FormatInt(*i, 10)
+}
+
+// handleExport streams the nodes matching the filter as CSV (format=csv,
+// the default) or newline delimited JSON (format=ndjson).
+func (a *Api) handleExport(rw http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	format := params.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "ndjson" {
+		http.Error(rw, "format must be csv or ndjson", http.StatusBadRequest)
+		return
+	}
+	where, args, err := addFilterArgs(map[string]string{"filter": params.Get("filter")})
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("invalid filter: %v", err), http.StatusBadRequest)
+		return
+	}
+	if args != nil {
+		where = "WHERE " + where
+	}
+
+	// The filter applies to the nodes table alone, the details share some
+	// column names with it.
+	rows, err := a.db.Query(fmt.Sprintf(`SELECT n.ID, IFNULL(name, ''),
+		IFNULL(version_major, 0) || '.' || IFNULL(version_minor, 0) || '.' || IFNULL(version_patch, 0) ||
+			CASE WHEN IFNULL(version_tag, '') != '' THEN '-' || version_tag ELSE '' END,
+		IFNULL(os_name, ''), IFNULL(os_architecture, ''),
+		IFNULL(language_name, ''), IFNULL(language_version, ''),
+		IFNULL(country_name, ''), last_crawled,
+		IFNULL(reachable, 0), latency_ms, IFNULL(vantage_points, 0),
+		IFNULL(n.fork_hash, ''), IFNULL(n.fork_next, 0),
+		IFNULL(hello_name, ''), IFNULL(ip, ''), IFNULL(tcp, 0), IFNULL(udp, 0), IFNULL(capabilities, ''),
+		first_seen, last_seen, IFNULL(score, 0), IFNULL(d.error_reason, 0), IFNULL(error_string, ''),
+		n.disconnect_reason, n.head_number, n.head_time, IFNULL(n.head_verified, 0),
+		CASE WHEN n.head_verified THEN (SELECT MAX(head_number) FROM nodes WHERE head_verified) - n.head_number END,
+		IFNULL(n.eth_version, 0), IFNULL(n.opera_version, 0)
+		FROM (SELECT * FROM nodes %v) AS n LEFT JOIN node_details AS d ON n.ID = d.ID
+		ORDER BY n.ID`, where), args...)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(rw, "query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var (
+		write func(row *exportRow) error
+		flush = func() {}
+	)
+	switch format {
+	case "csv":
+		rw.Header().Set("Content-Type", "text/csv")
+		rw.Header().Set("Content-Disposition", `attachment; filename="nodes.csv"`)
+		w := csv.NewWriter(rw)
+		defer w.Flush()
+		if err := w.Write(exportColumns); err != nil {
+			return
+		}
+		write = func(row *exportRow) error { return w.Write(row.csvRecord()) }
+		flush = w.Flush
+	case "ndjson":
+		rw.Header().Set("Content-Type", "application/x-ndjson")
+		rw.Header().Set("Content-Disposition", `attachment; filename="nodes.ndjson"`)
+		enc := json.NewEncoder(rw)
+		write = func(row *exportRow) error { return enc.Encode(row) }
+	}
+
+	flusher, _ := rw.(http.Flusher)
+	for count := 1; rows.Next(); count++ {
+		row, err := scanExportRow(rows)
+		if err != nil {
+			// The status is already sent, cut the export short.
+			fmt.Println(err)
+			return
+		}
+		if err := write(row); err != nil {
+			return
+		}
+		if count%exportFlushRows == 0 && flusher != nil {
+			flush()
+			flusher.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func scanExportRow(rows *sql.Rows) (*exportRow, error) {
+	var (
+		r                            exportRow
+		lastCrawled                  sql.NullTime
+		latency, firstSeen, lastSeen sql.NullInt64
+		disconnect, headNumber       sql.NullInt64
+		headTime, blocksBehind       sql.NullInt64
+	)
+	err := rows.Scan(&r.ID, &r.Name, &r.Version, &r.OSName, &r.OSArchitecture,
+		&r.LanguageName, &r.LanguageVersion, &r.Country, &lastCrawled,
+		&r.Reachable, &latency, &r.VantagePoints, &r.ForkHash, &r.ForkNext,
+		&r.HelloName, &r.IP, &r.TCP, &r.UDP, &r.Capabilities,
+		&firstSeen, &lastSeen, &r.Score, &r.ErrorReason, &r.ErrorString, &disconnect,
+		&headNumber, &headTime, &r.HeadVerified, &blocksBehind, &r.EthVersion, &r.OperaVersion)
+	if err != nil {
+		return nil, err
+	}
+	r.LastCrawled = lastCrawled.Time
+	r.ErrorClass = errorClass(r.ErrorReason)
+	r.Latency = nullInt(latency)
+	r.FirstSeen = nullInt(firstSeen)
+	r.LastSeen = nullInt(lastSeen)
+	r.Disconnect = nullInt(disconnect)
+	r.HeadNumber = nullInt(headNumber)
+	r.HeadTime = nullInt(headTime)
+	r.BlocksBehind = nullInt(blocksBehind)
+	return &r, nil
+}
+
+func nullInt(i sql.NullInt64) *int64 {
+	if !i.Valid {
+		return nil
+	}
+	return &i.Int64
+}
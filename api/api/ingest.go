@@ -0,0 +1,55 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/MariusVanDerWijden/node-crawler-backend/input"
+)
+
+// maxIngestBody limits the size of a single ingestion request.
+const maxIngestBody = 32 << 20
+
+// Ingester stores nodes pushed by a crawler.
+type Ingester func(nodes []input.CrawledNode) error
+
+// EnableIngestion serves the ingestion endpoint, which accepts batches of
+// crawled nodes from requests authenticated with the given bearer token.
+func (a *Api) EnableIngestion(token string, ingest Ingester) {
+	a.ingestToken = token
+	a.ingest = ingest
+}
+
+func (a *Api) handleIngest(rw http.ResponseWriter, r *http.Request) {
+	if a.ingest == nil {
+		http.Error(rw, "ingestion disabled", http.StatusNotFound)
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(a.ingestToken)) != 1 {
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var nodes []input.CrawledNode
+	if err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, maxIngestBody)).Decode(&nodes); err != nil {
+		http.Error(rw, fmt.Sprintf("invalid body: %v", err), http.StatusBadRequest)
+		return
+	}
+	for _, n := range nodes {
+		if n.ID == "" {
+			http.Error(rw, "node without id", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := a.ingest(nodes); err != nil {
+		fmt.Println(err)
+		http.Error(rw, "ingestion failed", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("%d nodes ingested\n", len(nodes))
+}
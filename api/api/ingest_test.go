@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/MariusVanDerWijden/node-crawler-backend/input"
+)
+
+func TestIngestAuthorization(t *testing.T) {
+	var ingested []input.CrawledNode
+	a := &Api{}
+	a.EnableIngestion("secret", func(nodes []input.CrawledNode) error {
+		ingested = append(ingested, nodes...)
+		return nil
+	})
+
+	tests := []struct {
+		auth string
+		want int
+	}{
+		{"Bearer secret", http.StatusOK},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"bearer secret", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		ingested = nil
+		req := httptest.NewRequest("POST", "/v1/ingest", strings.NewReader(`[{"id": "a"}]`))
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		rec := httptest.NewRecorder()
+		a.handleIngest(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("Authorization %q: got status %d, want %d", test.auth, rec.Code, test.want)
+		}
+		if ok := len(ingested) == 1; ok != (test.want == http.StatusOK) {
+			t.Errorf("Authorization %q: ingested %d nodes", test.auth, len(ingested))
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// latencyGroups maps the groupBy parameter of /v1/latency to the nodes
+// column it is read from.
+var latencyGroups = map[string]string{
+	"country": "country_name",
+	"client":  "name",
+}
+
+// latencyStages are the probe stages in the order of the observation
+// columns.
+var latencyStages = []string{"connect", "handshake", "hello", "status", "ping"}
+
+// latencyStats are the percentiles of a probe stage, in milliseconds.
+type latencyStats struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+}
+
+type latencyGroup struct {
+	Name         string                  `json:"name"`
+	Observations int                     `json:"observations"`
+	Stages       map[string]latencyStats `json:"stages"`
+}
+
+type latencyReport struct {
+	GroupBy string         `json:"groupBy"`
+	Range   int64          `json:"range"` // seconds
+	Groups  []latencyGroup `json:"groups"`
+}
+
+// handleLatency returns percentiles of the probe stage durations measured
+// by the crawlers. Query parameters:
+//
+//	groupBy: country or client (default country)
+//	range:   how far back from now, e.g. 7d (default 1d)
+//	crawler: only use the observations of this crawler
+func (a *Api) handleLatency(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Cache-Control", "max-age=600")
+	params := r.URL.Query()
+
+	groupBy := params.Get("groupBy")
+	if groupBy == "" {
+		groupBy = "country"
+	}
+	column, ok := latencyGroups[groupBy]
+	if !ok {
+		http.Error(rw, fmt.Sprintf("invalid groupBy %q", groupBy), http.StatusBadRequest)
+		return
+	}
+	window, err := parseDuration(params.Get("range"), 24*time.Hour)
+	if err != nil || window <= 0 {
+		http.Error(rw, "invalid range", http.StatusBadRequest)
+		return
+	}
+
+	query := fmt.Sprintf(`SELECT IFNULL(n.%v, ''), o.connect_ms, o.handshake_ms, o.hello_ms, o.status_ms, o.ping_ms
+		FROM node_observations AS o JOIN nodes AS n ON o.ID = n.ID
+		WHERE o.timestamp >= ?`, column)
+	args := []interface{}{time.Now().Add(-window).Unix()}
+	if crawler := params.Get("crawler"); crawler != "" {
+		query += " AND o.crawler_id = ?"
+		args = append(args, crawler)
+	}
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(rw, "query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type samples struct {
+		observations int
+		stages       [][]float64
+	}
+	groups := make(map[string]*samples)
+	for rows.Next() {
+		var (
+			name   string
+			values = make([]sql.NullFloat64, len(latencyStages))
+			dest   = []interface{}{&name}
+		)
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			fmt.Println(err)
+			http.Error(rw, "query failed", http.StatusInternalServerError)
+			return
+		}
+		g, ok := groups[name]
+		if !ok {
+			g = &samples{stages: make([][]float64, len(latencyStages))}
+			groups[name] = g
+		}
+		g.observations++
+		for i, v := range values {
+			if v.Valid {
+				g.stages[i] = append(g.stages[i], v.Float64)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Println(err)
+		http.Error(rw, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	report := latencyReport{GroupBy: groupBy, Range: int64(window.Seconds()), Groups: []latencyGroup{}}
+	for name, g := range groups {
+		group := latencyGroup{Name: name, Observations: g.observations, Stages: make(map[string]latencyStats)}
+		for i, values := range g.stages {
+			if len(values) == 0 {
+				continue
+			}
+			sort.Float64s(values)
+			group.Stages[latencyStages[i]] = latencyStats{
+				Count: len(values),
+				P50:   percentile(values, 50),
+				P90:   percentile(values, 90),
+				P99:   percentile(values, 99),
+			}
+		}
+		report.Groups = append(report.Groups, group)
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		if report.Groups[i].Observations != report.Groups[j].Observations {
+			return report.Groups[i].Observations > report.Groups[j].Observations
+		}
+		return report.Groups[i].Name < report.Groups[j].Name
+	})
+	json.NewEncoder(rw).Encode(report)
+}
+
+// percentile returns the p-th percentile of the sorted values using the
+// nearest-rank method.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
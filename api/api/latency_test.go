@@ -0,0 +1,18 @@
+package api
+
+import "testing"
+
+func TestPercentile(t *testing.T) {
+	values := []float64{15, 20, 35, 40, 50}
+	tests := []struct {
+		p    float64
+		want float64
+	}{
+		{0, 15}, {5, 15}, {30, 20}, {40, 20}, {50, 35}, {90, 50}, {100, 50},
+	}
+	for _, test := range tests {
+		if got := percentile(values, test.p); got != test.want {
+			t.Errorf("p%v: got %v, want %v", test.p, got, test.want)
+		}
+	}
+}
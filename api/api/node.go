@@ -0,0 +1,272 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+type nodeRecord struct {
+	ENR       string `json:"enr"`
+	Seq       uint64 `json:"seq"`
+	PublicKey string `json:"publicKey"`
+	IP        string `json:"ip"`
+	TCP       int    `json:"tcp"`
+	UDP       int    `json:"udp"`
+}
+
+type forkID struct {
+	Hash string `json:"hash"`
+	Next uint64 `json:"next"`
+}
+
+type nodeGeo struct {
+	Country   string   `json:"country"`
+	City      string   `json:"city"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+}
+
+type nodeError struct {
+	Reason     int             `json:"reason"`
+	Class      string          `json:"class"`
+	Message    string          `json:"message"`
+	Disconnect *nodeDisconnect `json:"disconnect,omitempty"`
+}
+
+// nodeHead is the head block of the node. Only verified heads count: the
+// highest of them is the reference of BlocksBehind, which is unset for
+// unverified heads.
+type nodeHead struct {
+	Number       uint64    `json:"number"`
+	Time         time.Time `json:"time"`
+	Verified     bool      `json:"verified"`
+	BlocksBehind *uint64   `json:"blocksBehind,omitempty"`
+}
+
+// nodeDisconnect is the p2p disconnect reason sent by the node.
+type nodeDisconnect struct {
+	Reason int    `json:"reason"`
+	Name   string `json:"name"`
+}
+
+type nodeObservation struct {
+	Timestamp    time.Time  `json:"timestamp"`
+	CrawlerID    string     `json:"crawlerId"`
+	Reachable    bool       `json:"reachable"`
+	Latency      int64      `json:"latency"` // milliseconds
+	HelloName    string     `json:"helloName"`
+	Capabilities []string   `json:"capabilities"`
+	NetworkID    uint64     `json:"networkId"`
+	ForkID       forkID     `json:"forkId"`
+	IP           string     `json:"ip"`
+	Score        int        `json:"score"`
+	HeadNumber   *int64     `json:"headNumber,omitempty"`
+	Error        *nodeError `json:"error,omitempty"`
+}
+
+type nodeDetail struct {
+	nodeRow
+	Reachable       bool              `json:"reachable"`
+	Latency         *int64            `json:"latency,omitempty"` // lowest of all crawlers, in milliseconds
+	VantagePoints   int               `json:"vantagePoints"`
+	HelloName       string            `json:"helloName"`
+	Record          nodeRecord        `json:"record"`
+	Capabilities    []string          `json:"capabilities"`
+	SoftwareVersion uint64            `json:"softwareVersion"`
+	EthVersion      uint              `json:"ethVersion"`   // negotiated, 0 if none
+	OperaVersion    uint              `json:"operaVersion"` // negotiated, 0 if none
+	NetworkID       uint64            `json:"networkId"`
+	ForkID          forkID            `json:"forkId"`
+	Geo             nodeGeo           `json:"geo"`
+	FirstSeen       *time.Time        `json:"firstSeen,omitempty"`
+	LastSeen        *time.Time        `json:"lastSeen,omitempty"`
+	Score           int               `json:"score"`
+	Head            *nodeHead         `json:"head,omitempty"`
+	LastError       *nodeError        `json:"lastError,omitempty"`
+	History         []nodeObservation `json:"history"`
+}
+
+// handleNode returns everything known about a single node. The history
+// parameter limits the number of observations (default 100, max 1000),
+// newest first.
+func (a *Api) handleNode(rw http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	limit := defaultHistoryLimit
+	if l := r.URL.Query().Get("history"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			http.Error(rw, "invalid history limit", http.StatusBadRequest)
+			return
+		}
+		if limit > maxHistoryLimit {
+			limit = maxHistoryLimit
+		}
+	}
+
+	node, err := queryNodeDetail(a.db, id)
+	if err == sql.ErrNoRows {
+		http.Error(rw, "node not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		node.History, err = queryNodeHistory(a.db, id, limit)
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(rw, "query failed", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(rw).Encode(node)
+}
+
+func queryNodeDetail(db *sql.DB, id string) (*nodeDetail, error) {
+	var (
+		n                   nodeDetail
+		lastCrawled         sql.NullTime
+		latency             sql.NullInt64
+		firstSeen, lastSeen sql.NullInt64
+		caps                string
+		errorReason         int
+		errorString         string
+		disconnect          sql.NullInt64
+		headNumber          sql.NullInt64
+		headTime            sql.NullInt64
+		headVerified        bool
+		highestHead         int64
+	)
+	err := db.QueryRow(`SELECT nodes.ID, IFNULL(name, ''),
+		IFNULL(version_major, 0), IFNULL(version_minor, 0), IFNULL(version_patch, 0),
+		IFNULL(version_tag, ''), IFNULL(version_build, ''), IFNULL(version_date, ''),
+		IFNULL(os_name, ''), IFNULL(os_architecture, ''),
+		IFNULL(language_name, ''), IFNULL(language_version, ''),
+		IFNULL(country_name, ''), last_crawled,
+		IFNULL(reachable, 0), latency_ms, IFNULL(vantage_points, 0),
+		IFNULL(hello_name, ''), IFNULL(enr, ''), IFNULL(seq, 0), IFNULL(public_key, ''),
+		IFNULL(ip, ''), IFNULL(tcp, 0), IFNULL(udp, 0),
+		IFNULL(capabilities, ''), IFNULL(software_version, 0), IFNULL(network_id, 0),
+		IFNULL(node_details.fork_hash, ''), IFNULL(node_details.fork_next, 0),
+		IFNULL(city, ''), latitude, longitude, first_seen, last_seen, IFNULL(score, 0),
+		IFNULL(node_details.error_reason, 0), IFNULL(error_string, ''), nodes.disconnect_reason,
+		nodes.head_number, nodes.head_time, IFNULL(nodes.head_verified, 0),
+		(SELECT IFNULL(MAX(head_number), 0) FROM nodes WHERE head_verified),
+		IFNULL(nodes.eth_version, 0), IFNULL(nodes.opera_version, 0)
+		FROM nodes LEFT JOIN node_details ON nodes.ID = node_details.ID
+		WHERE nodes.ID = ?`, id).Scan(
+		&n.ID, &n.Name,
+		&n.Version.Major, &n.Version.Minor, &n.Version.Patch,
+		&n.Version.Tag, &n.Version.Build, &n.Version.Date,
+		&n.OS.Name, &n.OS.Architecture,
+		&n.Language.Name, &n.Language.Version,
+		&n.Country, &lastCrawled,
+		&n.Reachable, &latency, &n.VantagePoints,
+		&n.HelloName, &n.Record.ENR, &n.Record.Seq, &n.Record.PublicKey,
+		&n.Record.IP, &n.Record.TCP, &n.Record.UDP,
+		&caps, &n.SoftwareVersion, &n.NetworkID,
+		&n.ForkID.Hash, &n.ForkID.Next,
+		&n.Geo.City, &n.Geo.Latitude, &n.Geo.Longitude, &firstSeen, &lastSeen, &n.Score,
+		&errorReason, &errorString, &disconnect,
+		&headNumber, &headTime, &headVerified, &highestHead,
+		&n.EthVersion, &n.OperaVersion,
+	)
+	if err != nil {
+		return nil, err
+	}
+	n.LastCrawled = lastCrawled.Time
+	if latency.Valid {
+		n.Latency = &latency.Int64
+	}
+	n.Capabilities = splitCapabilities(caps)
+	n.Geo.Country = n.Country
+	n.FirstSeen = nullTime(firstSeen)
+	n.LastSeen = nullTime(lastSeen)
+	n.LastError = makeNodeError(errorReason, errorString, disconnect)
+	if headNumber.Valid {
+		n.Head = &nodeHead{
+			Number:   uint64(headNumber.Int64),
+			Time:     time.Unix(headTime.Int64, 0),
+			Verified: headVerified,
+		}
+		if headVerified {
+			behind := uint64(highestHead - headNumber.Int64)
+			n.Head.BlocksBehind = &behind
+		}
+	}
+	return &n, nil
+}
+
+func queryNodeHistory(db *sql.DB, id string, limit int) ([]nodeObservation, error) {
+	rows, err := db.Query(`SELECT timestamp, crawler_id, IFNULL(reachable, 0), IFNULL(latency_ms, 0),
+		IFNULL(hello_name, ''), IFNULL(capabilities, ''), IFNULL(network_id, 0),
+		IFNULL(fork_hash, ''), IFNULL(fork_next, 0), IFNULL(ip, ''), IFNULL(score, 0),
+		IFNULL(error_reason, 0), IFNULL(error_string, ''), disconnect_reason, head_number
+		FROM node_observations WHERE ID = ? ORDER BY timestamp DESC LIMIT ?`, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []nodeObservation{}
+	for rows.Next() {
+		var (
+			o           nodeObservation
+			timestamp   int64
+			caps        string
+			errorReason int
+			errorString string
+			disconnect  sql.NullInt64
+			headNumber  sql.NullInt64
+		)
+		err := rows.Scan(&timestamp, &o.CrawlerID, &o.Reachable, &o.Latency,
+			&o.HelloName, &caps, &o.NetworkID,
+			&o.ForkID.Hash, &o.ForkID.Next, &o.IP, &o.Score,
+			&errorReason, &errorString, &disconnect, &headNumber)
+		if err != nil {
+			return nil, err
+		}
+		o.Timestamp = time.Unix(timestamp, 0)
+		o.Capabilities = splitCapabilities(caps)
+		o.Error = makeNodeError(errorReason, errorString, disconnect)
+		o.HeadNumber = nullInt(headNumber)
+		history = append(history, o)
+	}
+	return history, rows.Err()
+}
+
+func splitCapabilities(caps string) []string {
+	if caps == "" {
+		return []string{}
+	}
+	return strings.Split(caps, ",")
+}
+
+func nullTime(t sql.NullInt64) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	tm := time.Unix(t.Int64, 0)
+	return &tm
+}
+
+func makeNodeError(reason int, message string, disconnect sql.NullInt64) *nodeError {
+	if reason == 0 && message == "" && !disconnect.Valid {
+		return nil
+	}
+	e := &nodeError{Reason: reason, Class: errorClass(reason), Message: message}
+	if disconnect.Valid {
+		r := int(disconnect.Int64)
+		e.Disconnect = &nodeDisconnect{Reason: r, Name: disconnectReason(r)}
+	}
+	return e
+}
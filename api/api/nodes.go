@@ -0,0 +1,237 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultNodesLimit = 100
+	maxNodesLimit     = 1000
+)
+
+// nodeSortKeys maps the sort parameter of /v1/nodes to the expressions the
+// nodes are ordered by. Every key ends in the ID so the order is total, which
+// keeps the cursor pagination stable.
+var nodeSortKeys = map[string][]string{
+	"id":            {"ID"},
+	"name":          {"IFNULL(name, '')", "ID"},
+	"version":       {"IFNULL(version_major, -1)", "IFNULL(version_minor, -1)", "IFNULL(version_patch, -1)", "IFNULL(version_tag, '')", "ID"},
+	"os_name":       {"IFNULL(os_name, '')", "ID"},
+	"language_name": {"IFNULL(language_name, '')", "ID"},
+	"country_name":  {"IFNULL(country_name, '')", "ID"},
+	"last_crawled":  {"IFNULL(CAST(last_crawled AS TEXT), '')", "ID"},
+}
+
+type nodeVersion struct {
+	Major int    `json:"major"`
+	Minor int    `json:"minor"`
+	Patch int    `json:"patch"`
+	Tag   string `json:"tag"`
+	Build string `json:"build"`
+	Date  string `json:"date"`
+}
+
+type nodeOS struct {
+	Name         string `json:"name"`
+	Architecture string `json:"architecture"`
+}
+
+type nodeLanguage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type nodeRow struct {
+	ID          string       `json:"id"`
+	Name        string       `json:"name"`
+	Version     nodeVersion  `json:"version"`
+	OS          nodeOS       `json:"os"`
+	Language    nodeLanguage `json:"language"`
+	Country     string       `json:"country"`
+	LastCrawled time.Time    `json:"lastCrawled"`
+}
+
+type nodePage struct {
+	Nodes []nodeRow `json:"nodes"`
+	// Next is the cursor of the following page, empty on the last page.
+	Next string `json:"next,omitempty"`
+}
+
+// handleNodes lists the nodes matching the filter, one page at a time.
+// Query parameters:
+//
+//	filter: same syntax as for /v1/dashboard
+//	sort:   one of the keys of nodeSortKeys (default id)
+//	order:  asc or desc (default asc)
+//	limit:  page size (default 100, max 1000)
+//	cursor: the next value of the previous page
+func (a *Api) handleNodes(rw http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	sort := params.Get("sort")
+	if sort == "" {
+		sort = "id"
+	}
+	keys, ok := nodeSortKeys[sort]
+	if !ok {
+		http.Error(rw, fmt.Sprintf("invalid sort key %q", sort), http.StatusBadRequest)
+		return
+	}
+	var desc bool
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		desc = true
+	default:
+		http.Error(rw, "order must be asc or desc", http.StatusBadRequest)
+		return
+	}
+	limit := defaultNodesLimit
+	if l := params.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			http.Error(rw, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		if limit > maxNodesLimit {
+			limit = maxNodesLimit
+		}
+	}
+
+	var conditions []string
+	filter, args, err := addFilterArgs(map[string]string{"filter": params.Get("filter")})
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("invalid filter: %v", err), http.StatusBadRequest)
+		return
+	}
+	if args != nil {
+		conditions = append(conditions, "("+filter+")")
+	}
+	if c := params.Get("cursor"); c != "" {
+		after, err := decodeCursor(c, len(keys))
+		if err != nil {
+			http.Error(rw, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		comp := ">"
+		if desc {
+			comp = "<"
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(keys)), ", ")
+		conditions = append(conditions, fmt.Sprintf("(%v) %v (%v)", strings.Join(keys, ", "), comp, placeholders))
+		args = append(args, after...)
+	}
+
+	order := make([]string, len(keys))
+	for i, key := range keys {
+		order[i] = key
+		if desc {
+			order[i] += " DESC"
+		}
+	}
+	query := fmt.Sprintf(`SELECT ID, IFNULL(name, ''),
+		IFNULL(version_major, 0), IFNULL(version_minor, 0), IFNULL(version_patch, 0),
+		IFNULL(version_tag, ''), IFNULL(version_build, ''), IFNULL(version_date, ''),
+		IFNULL(os_name, ''), IFNULL(os_architecture, ''),
+		IFNULL(language_name, ''), IFNULL(language_version, ''),
+		IFNULL(country_name, ''), last_crawled, %v
+		FROM nodes`, strings.Join(keys, ", "))
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	// Query one more node than requested to find out whether there is a next page.
+	query += fmt.Sprintf(" ORDER BY %v LIMIT %d", strings.Join(order, ", "), limit+1)
+
+	page, err := queryNodePage(a.db, query, args, len(keys), limit)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(rw, "query failed", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(rw).Encode(page)
+}
+
+func queryNodePage(db *sql.DB, query string, args []interface{}, numKeys, limit int) (*nodePage, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &nodePage{Nodes: []nodeRow{}}
+	var lastKey []interface{}
+	for rows.Next() {
+		if len(page.Nodes) == limit {
+			if page.Next, err = encodeCursor(lastKey); err != nil {
+				return nil, err
+			}
+			break
+		}
+		var (
+			n           nodeRow
+			lastCrawled sql.NullTime
+			key         = make([]interface{}, numKeys)
+		)
+		dest := []interface{}{
+			&n.ID, &n.Name,
+			&n.Version.Major, &n.Version.Minor, &n.Version.Patch,
+			&n.Version.Tag, &n.Version.Build, &n.Version.Date,
+			&n.OS.Name, &n.OS.Architecture,
+			&n.Language.Name, &n.Language.Version,
+			&n.Country, &lastCrawled,
+		}
+		for i := range key {
+			dest = append(dest, &key[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		n.LastCrawled = lastCrawled.Time
+		page.Nodes = append(page.Nodes, n)
+		lastKey = key
+	}
+	return page, rows.Err()
+}
+
+// encodeCursor encodes the sort key values of the last node of a page.
+func encodeCursor(key []interface{}) (string, error) {
+	for i, v := range key {
+		if b, ok := v.([]byte); ok {
+			key[i] = string(b)
+		}
+	}
+	enc, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(enc), nil
+}
+
+func decodeCursor(cursor string, numKeys int) ([]interface{}, error) {
+	dec, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var key []interface{}
+	if err := json.Unmarshal(dec, &key); err != nil {
+		return nil, err
+	}
+	if len(key) != numKeys {
+		return nil, fmt.Errorf("cursor has %d values, want %d", len(key), numKeys)
+	}
+	for _, v := range key {
+		switch v.(type) {
+		case string, float64:
+		default:
+			return nil, fmt.Errorf("invalid cursor value %v", v)
+		}
+	}
+	return key, nil
+}
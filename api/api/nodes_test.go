@@ -0,0 +1,98 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestApi(t *testing.T) *Api {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec(`CREATE TABLE nodes (
+		ID text not null,
+		name text,
+		version_major number,
+		version_minor number,
+		version_patch number,
+		version_tag text,
+		version_build text,
+		version_date text,
+		os_name text,
+		os_architecture text,
+		language_name text,
+		language_version text,
+		last_crawled datetime,
+		country_name text,
+		PRIMARY KEY (ID)
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Api{db: db}
+}
+
+func TestNodesPagination(t *testing.T) {
+	a := newTestApi(t)
+	nodes := []struct {
+		id, name string
+		major    int
+	}{
+		{"a", "go-opera", 1}, {"b", "go-opera", 1}, {"c", "go-opera", 2},
+		{"d", "geth", 1}, {"e", "go-opera", 1},
+	}
+	for _, n := range nodes {
+		_, err := a.db.Exec(`INSERT INTO nodes(ID, name, version_major, version_minor, version_patch, last_crawled) VALUES(?,?,?,0,0,?)`,
+			n.id, n.name, n.major, time.Unix(1, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	params := url.Values{
+		"filter": {`[["name:go-opera"]]`},
+		"sort":   {"version"},
+		"order":  {"desc"},
+		"limit":  {"2"},
+	}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		rec := httptest.NewRecorder()
+		a.handleNodes(rec, httptest.NewRequest("GET", "/v1/nodes?"+params.Encode(), nil))
+		if rec.Code != 200 {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		var page nodePage
+		if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range page.Nodes {
+			got = append(got, n.ID)
+		}
+		if page.Next == "" {
+			break
+		}
+		params.Set("cursor", page.Next)
+	}
+	want := []string{"c", "e", "b", "a"}
+	if len(got) != len(want) {
+		t.Fatalf("wrong nodes: got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("wrong nodes: got %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package api
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ready    = "ready"
+	notReady = "notReady"
+	unknown  = "unknown"
+)
+
+// minVersion is the lowest release of a client which supports an upgrade.
+type minVersion struct {
+	Major, Minor, Patch int
+	Tag                 string
+}
+
+// parseMinVersions parses a comma separated list of client/version pairs,
+// e.g. "go-opera/1.1.1,go-opera-xx/1.0.0-rc.2".
+func parseMinVersions(s string) (map[string]minVersion, error) {
+	versions := make(map[string]minVersion)
+	if strings.TrimSpace(s) == "" {
+		return versions, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		split := strings.SplitN(strings.TrimSpace(entry), "/", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("invalid minimum client version %q, want client/version", entry)
+		}
+		var v minVersion
+		version := strings.TrimPrefix(split[1], "v")
+		if idx := strings.Index(version, "-"); idx >= 0 {
+			version, v.Tag = version[:idx], version[idx+1:]
+		}
+		parts := strings.Split(version, ".")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid minimum client version %q, want major.minor.patch", entry)
+		}
+		numbers := []*int{&v.Major, &v.Minor, &v.Patch}
+		for i, part := range parts {
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid minimum client version %q: %v", entry, err)
+			}
+			*numbers[i] = n
+		}
+		versions[strings.ToLower(split[0])] = v
+	}
+	return versions, nil
+}
+
+// satisfies reports whether the version is at least the minimum version.
+// Pre-releases come before the release.
+func (m minVersion) satisfies(major, minor, patch int, tag string) bool {
+	if major != m.Major {
+		return major > m.Major
+	}
+	if minor != m.Minor {
+		return minor > m.Minor
+	}
+	if patch != m.Patch {
+		return patch > m.Patch
+	}
+	if tag == "" || m.Tag == "" {
+		return tag == "" || m.Tag != ""
+	}
+	return comparePrerelease(tag, m.Tag) >= 0
+}
+
+// comparePrerelease compares two pre-release tags by their dot separated
+// identifiers like semver: numeric identifiers compare numerically and before
+// alphanumeric ones, so rc.2 comes before rc.10.
+func comparePrerelease(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.ParseUint(as[i], 10, 64)
+		bn, bErr := strconv.ParseUint(bs[i], 10, 64)
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// forkSchedule holds the fork ID checksums of a chain (EIP-2124), used to
+// tell whether a node has passed a fork.
+type forkSchedule struct {
+	genesis uint32   // checksum of the genesis hash
+	forks   []uint64 // fork blocks, ascending
+}
+
+// parseForkSchedule parses the hex encoded hash of the genesis block whose
+// checksum starts the fork IDs, and the comma separated fork blocks of the
+// chain config.
+func parseForkSchedule(genesis, forks string) (*forkSchedule, error) {
+	hash, err := hex.DecodeString(strings.TrimPrefix(genesis, "0x"))
+	if err != nil || len(hash) != 32 {
+		return nil, fmt.Errorf("invalid genesis hash %q", genesis)
+	}
+	s := &forkSchedule{genesis: crc32.ChecksumIEEE(hash)}
+	if strings.TrimSpace(forks) != "" {
+		for _, f := range strings.Split(forks, ",") {
+			block, err := strconv.ParseUint(strings.TrimSpace(f), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid fork block %q", f)
+			}
+			s.forks = append(s.forks, block)
+		}
+	}
+	return s, nil
+}
+
+// checksums returns the fork hashes of the chain with the given fork added,
+// and the index of the hash announced right before the fork. Forks at the
+// genesis and duplicates don't change the hash.
+func (s *forkSchedule) checksums(forkBlock uint64) ([]string, int) {
+	forks := append([]uint64{forkBlock}, s.forks...)
+	sort.Slice(forks, func(i, j int) bool { return forks[i] < forks[j] })
+
+	var (
+		sum    = s.genesis
+		sums   = []string{fmt.Sprintf("0x%08x", sum)}
+		before int
+		prev   uint64
+	)
+	for _, f := range forks {
+		if f == 0 || f == prev {
+			continue
+		}
+		if f == forkBlock {
+			before = len(sums) - 1
+		}
+		var blob [8]byte
+		binary.BigEndian.PutUint64(blob[:], f)
+		sum = crc32.Update(sum, crc32.IEEETable, blob[:])
+		sums = append(sums, fmt.Sprintf("0x%08x", sum))
+		prev = f
+	}
+	return sums, before
+}
+
+// forkReadiness judges a node by its fork ID. Without a fork schedule only
+// nodes announcing the fork as next are known to be ready. Nodes still
+// syncing below an earlier fork only announce that one, so are unknown, as
+// are nodes of other chains.
+func forkReadiness(schedule *forkSchedule, forkBlock uint64, hash string, next uint64) string {
+	if next == forkBlock {
+		return ready
+	}
+	if schedule == nil {
+		return unknown
+	}
+	sums, before := schedule.checksums(forkBlock)
+	for i, sum := range sums {
+		if sum != hash {
+			continue
+		}
+		switch {
+		case i > before:
+			return ready
+		case i == before:
+			return notReady
+		}
+	}
+	return unknown
+}
+
+// SetReadiness configures the upgrade which /v1/readiness reports on by
+// default. A node is ready if its fork ID announces the fork block or, given
+// the genesis hash and fork blocks of the chain, shows it passed the fork.
+// Other nodes, like opera peers which don't speak eth and so send no fork
+// ID, are ready if they run at least the minimum client version.
+func (a *Api) SetReadiness(forkBlock uint64, genesis, forks, minVersions string) error {
+	versions, err := parseMinVersions(minVersions)
+	if err != nil {
+		return err
+	}
+	if genesis != "" {
+		if a.forkSchedule, err = parseForkSchedule(genesis, forks); err != nil {
+			return err
+		}
+	}
+	a.forkBlock = forkBlock
+	a.minVersions = versions
+	return nil
+}
+
+type readinessGroup struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Ready    int    `json:"ready"`
+	NotReady int    `json:"notReady"`
+	Unknown  int    `json:"unknown"`
+}
+
+type readinessResult struct {
+	ForkBlock   uint64            `json:"forkBlock,omitempty"`
+	MinVersions map[string]string `json:"minVersions,omitempty"`
+	Ready       int               `json:"ready"`
+	NotReady    int               `json:"notReady"`
+	Unknown     int               `json:"unknown"`
+	Clients     []readinessGroup  `json:"clients"`
+}
+
+// handleReadiness counts the nodes which are ready for the configured
+// upgrade, by client and version. The forkBlock and minVersion query
+// parameters override the configuration.
+func (a *Api) handleReadiness(rw http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	forkBlock, minVersions := a.forkBlock, a.minVersions
+	if b := params.Get("forkBlock"); b != "" {
+		var err error
+		if forkBlock, err = strconv.ParseUint(b, 10, 64); err != nil {
+			http.Error(rw, "invalid forkBlock", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("minVersion"); v != "" {
+		var err error
+		if minVersions, err = parseMinVersions(v); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if forkBlock == 0 && len(minVersions) == 0 {
+		http.Error(rw, "no upgrade configured, set forkBlock or minVersion", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := a.db.Query(`SELECT IFNULL(name, ''),
+		IFNULL(version_major, 0), IFNULL(version_minor, 0), IFNULL(version_patch, 0), IFNULL(version_tag, ''),
+		IFNULL(fork_hash, ''), IFNULL(fork_next, 0) FROM nodes`)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(rw, "query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	res := readinessResult{ForkBlock: forkBlock, Clients: []readinessGroup{}}
+	if len(minVersions) > 0 {
+		res.MinVersions = make(map[string]string)
+		for name, v := range minVersions {
+			res.MinVersions[name] = formatVersion(v.Major, v.Minor, v.Patch, v.Tag)
+		}
+	}
+	groups := make(map[[2]string]*readinessGroup)
+	for rows.Next() {
+		var (
+			name, tag, forkHash string
+			major, minor, patch int
+			forkNext            uint64
+		)
+		if err := rows.Scan(&name, &major, &minor, &patch, &tag, &forkHash, &forkNext); err != nil {
+			fmt.Println(err)
+			http.Error(rw, "query failed", http.StatusInternalServerError)
+			return
+		}
+		state := unknown
+		if forkBlock != 0 && hasForkID(forkHash) {
+			state = forkReadiness(a.forkSchedule, forkBlock, forkHash, forkNext)
+		}
+		if min, ok := minVersions[name]; state == unknown && ok && major+minor+patch > 0 {
+			state = notReady
+			if min.satisfies(major, minor, patch, tag) {
+				state = ready
+			}
+		}
+
+		version := formatVersion(major, minor, patch, tag)
+		g, ok := groups[[2]string{name, version}]
+		if !ok {
+			g = &readinessGroup{Name: name, Version: version}
+			groups[[2]string{name, version}] = g
+		}
+		switch state {
+		case ready:
+			g.Ready++
+			res.Ready++
+		case notReady:
+			g.NotReady++
+			res.NotReady++
+		default:
+			g.Unknown++
+			res.Unknown++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Println(err)
+		http.Error(rw, "query failed", http.StatusInternalServerError)
+		return
+	}
+	for _, g := range groups {
+		res.Clients = append(res.Clients, *g)
+	}
+	sort.Slice(res.Clients, func(i, j int) bool {
+		if res.Clients[i].Name != res.Clients[j].Name {
+			return res.Clients[i].Name < res.Clients[j].Name
+		}
+		return res.Clients[i].Version < res.Clients[j].Version
+	})
+	json.NewEncoder(rw).Encode(res)
+}
+
+// hasForkID reports whether the node announced a fork ID in its status.
+func hasForkID(hash string) bool {
+	return hash != "" && hash != "0x00000000"
+}
+
+func formatVersion(major, minor, patch int, tag string) string {
+	v := fmt.Sprintf("%d.%d.%d", major, minor, patch)
+	if tag != "" {
+		v += "-" + tag
+	}
+	return v
+}
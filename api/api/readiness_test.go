@@ -0,0 +1,89 @@
+package api
+
+import "testing"
+
+func TestMinVersionSatisfies(t *testing.T) {
+	versions, err := parseMinVersions("go-opera/1.1.1, Other/v2.0.0-rc.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		client              string
+		major, minor, patch int
+		tag                 string
+		want                bool
+	}{
+		{"go-opera", 1, 1, 1, "", true},
+		{"go-opera", 1, 2, 0, "", true},
+		{"go-opera", 1, 1, 0, "", false},
+		{"go-opera", 1, 1, 1, "rc.1", false},
+		{"other", 2, 0, 0, "rc.2", true},
+		{"other", 2, 0, 0, "rc.1", false},
+		{"other", 2, 0, 0, "", true},
+		{"other", 2, 0, 0, "rc.10", true},
+		{"other", 2, 0, 0, "rc.2.1", true},
+		{"other", 2, 0, 0, "rc", false},
+		{"other", 2, 0, 0, "beta.3", false},
+		{"other", 2, 0, 0, "rc.x", true},
+	}
+	for _, test := range tests {
+		min, ok := versions[test.client]
+		if !ok {
+			t.Fatalf("no minimum version for %v", test.client)
+		}
+		if got := min.satisfies(test.major, test.minor, test.patch, test.tag); got != test.want {
+			t.Errorf("%v %v: got %v, want %v", test.client, formatVersion(test.major, test.minor, test.patch, test.tag), got, test.want)
+		}
+	}
+	if _, err := parseMinVersions("go-opera"); err == nil {
+		t.Error("expected error for version without client")
+	}
+}
+
+func TestForkReadiness(t *testing.T) {
+	// Ethereum mainnet, with London as the upgrade.
+	schedule, err := parseForkSchedule("0xd4e56740f876aef8c010b86a40d5f56745a118d0906a34e69aec8c0db1cb8fa3",
+		"1150000,1920000,2463000,2675000,2675000,4370000,7280000,7280000,9069000,9200000,12244000,12965000,13773000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const london = 12965000
+	tests := []struct {
+		schedule *forkSchedule
+		hash     string
+		next     uint64
+		want     string
+	}{
+		{schedule, "0x0eb440f6", london, ready},     // Berlin, announcing London
+		{schedule, "0x0eb440f6", 0, notReady},       // Berlin, without London
+		{schedule, "0xb715077d", 13773000, ready},   // London
+		{schedule, "0x20c327fc", 0, ready},          // Arrow Glacier
+		{schedule, "0xe029e991", 12244000, unknown}, // syncing before Berlin
+		{schedule, "0xfc64ec04", 1150000, unknown},  // unsynced
+		{schedule, "0xdeadbeef", 0, unknown},        // other chain
+		{nil, "0x0eb440f6", london, ready},
+		{nil, "0x0eb440f6", 0, unknown},
+		{nil, "0xb715077d", 13773000, unknown},
+	}
+	for _, test := range tests {
+		if got := forkReadiness(test.schedule, london, test.hash, test.next); got != test.want {
+			t.Errorf("fork ID %v/%d: got %v, want %v", test.hash, test.next, got, test.want)
+		}
+	}
+
+	// The upgrade doesn't need to be part of the configured forks.
+	schedule, err = parseForkSchedule("0xd4e56740f876aef8c010b86a40d5f56745a118d0906a34e69aec8c0db1cb8fa3",
+		"1150000,1920000,2463000,2675000,4370000,7280000,9069000,9200000,12244000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := forkReadiness(schedule, london, "0xb715077d", 0); got != ready {
+		t.Errorf("node past the upgrade: got %v, want %v", got, ready)
+	}
+	if _, err := parseForkSchedule("0x1234", ""); err == nil {
+		t.Error("expected error for invalid genesis hash")
+	}
+	if _, err := parseForkSchedule("0xd4e56740f876aef8c010b86a40d5f56745a118d0906a34e69aec8c0db1cb8fa3", "1,x"); err == nil {
+		t.Error("expected error for invalid fork block")
+	}
+}
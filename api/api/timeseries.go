@@ -0,0 +1,171 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeseriesMetrics maps the metric parameter of /v1/timeseries to the
+// snapshot column it is read from.
+var timeseriesMetrics = map[string]string{
+	"nodes":     "nodes",
+	"reachable": "reachable",
+}
+
+// timeseriesGroups are the groupings recorded in the snapshots.
+var timeseriesGroups = map[string]struct{}{
+	"client":   {},
+	"version":  {},
+	"language": {},
+	"os":       {},
+	"country":  {},
+}
+
+type point struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+type series struct {
+	Name   string  `json:"name"`
+	Points []point `json:"points"`
+}
+
+type timeseries struct {
+	Metric   string   `json:"metric"`
+	GroupBy  string   `json:"groupBy"`
+	Interval int64    `json:"interval"` // seconds
+	Series   []series `json:"series"`
+}
+
+// handleTimeseries returns the snapshotted node counts over time.
+// Query parameters:
+//
+//	metric:   nodes or reachable (default nodes)
+//	groupBy:  client, version, language, os or country (default client)
+//	interval: bucket size, e.g. 6h or 1d (default 1d); the value of a
+//	          bucket is the average of its snapshots
+//	range:    how far back from now, e.g. 30d (default 7d)
+func (a *Api) handleTimeseries(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Cache-Control", "max-age=600")
+	params := r.URL.Query()
+
+	metric := params.Get("metric")
+	if metric == "" {
+		metric = "nodes"
+	}
+	column, ok := timeseriesMetrics[metric]
+	if !ok {
+		http.Error(rw, fmt.Sprintf("invalid metric %q", metric), http.StatusBadRequest)
+		return
+	}
+	groupBy := params.Get("groupBy")
+	if groupBy == "" {
+		groupBy = "client"
+	}
+	if _, ok := timeseriesGroups[groupBy]; !ok {
+		http.Error(rw, fmt.Sprintf("invalid groupBy %q", groupBy), http.StatusBadRequest)
+		return
+	}
+	interval, err := parseDuration(params.Get("interval"), 24*time.Hour)
+	if err != nil || interval < time.Minute {
+		http.Error(rw, "invalid interval", http.StatusBadRequest)
+		return
+	}
+	window, err := parseDuration(params.Get("range"), 7*24*time.Hour)
+	if err != nil || window <= 0 {
+		http.Error(rw, "invalid range", http.StatusBadRequest)
+		return
+	}
+	step := int64(interval / time.Second)
+	from := time.Now().Add(-window).Unix()
+
+	// Groups without nodes are missing from a snapshot, so the average
+	// divides by the number of snapshots in the bucket.
+	snapshots := make(map[int64]int)
+	rows, err := a.db.Query(`SELECT (timestamp / ?) * ? AS bucket, COUNT(*) FROM snapshots
+		WHERE timestamp >= ? GROUP BY bucket`, step, step, from)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(rw, "query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bucket int64
+		var count int
+		if err := rows.Scan(&bucket, &count); err != nil {
+			fmt.Println(err)
+			http.Error(rw, "query failed", http.StatusInternalServerError)
+			return
+		}
+		snapshots[bucket] = count
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Println(err)
+		http.Error(rw, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err = a.db.Query(fmt.Sprintf(`SELECT (timestamp / ?) * ? AS bucket, name, SUM(%v) FROM snapshot_counts
+		WHERE dimension = ? AND timestamp >= ? GROUP BY bucket, name ORDER BY bucket`, column),
+		step, step, groupBy, from)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(rw, "query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	byName := make(map[string]*series)
+	for rows.Next() {
+		var (
+			bucket int64
+			name   string
+			sum    float64
+		)
+		if err := rows.Scan(&bucket, &name, &sum); err != nil {
+			fmt.Println(err)
+			http.Error(rw, "query failed", http.StatusInternalServerError)
+			return
+		}
+		// Without the number of snapshots the bucket can't be averaged.
+		if snapshots[bucket] == 0 {
+			continue
+		}
+		s, ok := byName[name]
+		if !ok {
+			s = &series{Name: name}
+			byName[name] = s
+		}
+		s.Points = append(s.Points, point{Timestamp: bucket, Value: sum / float64(snapshots[bucket])})
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Println(err)
+		http.Error(rw, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	res := timeseries{Metric: metric, GroupBy: groupBy, Interval: step, Series: []series{}}
+	for _, s := range byName {
+		res.Series = append(res.Series, *s)
+	}
+	sort.Slice(res.Series, func(i, j int) bool { return res.Series[i].Name < res.Series[j].Name })
+	json.NewEncoder(rw).Encode(res)
+}
+
+// parseDuration parses a duration which may also be given in days, e.g. 7d.
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		return time.Duration(n) * 24 * time.Hour, err
+	}
+	return time.ParseDuration(s)
+}
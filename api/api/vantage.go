@@ -0,0 +1,47 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// vantagePoint summarizes what a single crawler instance sees of the network.
+type vantagePoint struct {
+	CrawlerID string  `json:"crawlerId"`
+	Nodes     int     `json:"nodes"`
+	Reachable int     `json:"reachable"`
+	Latency   float64 `json:"latency"` // average in milliseconds over reachable nodes
+	LastSeen  int64   `json:"lastSeen"`
+}
+
+func (a *Api) handleVantagePoints(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Cache-Control", "max-age=600")
+
+	rows, err := a.db.Query(`SELECT crawler_id, COUNT(*), IFNULL(SUM(reachable), 0),
+		IFNULL(AVG(CASE WHEN reachable THEN latency_ms END), 0), MAX(last_seen)
+		FROM node_vantages GROUP BY crawler_id ORDER BY crawler_id`)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(rw, "query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	vantages := []vantagePoint{}
+	for rows.Next() {
+		var v vantagePoint
+		if err := rows.Scan(&v.CrawlerID, &v.Nodes, &v.Reachable, &v.Latency, &v.LastSeen); err != nil {
+			fmt.Println(err)
+			http.Error(rw, "query failed", http.StatusInternalServerError)
+			return
+		}
+		vantages = append(vantages, v)
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Println(err)
+		http.Error(rw, "query failed", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(rw).Encode(vantages)
+}
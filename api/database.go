@@ -6,33 +6,13 @@ import (
 	"time"
 
 	"github.com/MariusVanDerWijden/node-crawler-backend/input"
+	"github.com/MariusVanDerWijden/node-crawler-backend/metrics"
 	"github.com/MariusVanDerWijden/node-crawler-backend/parser"
 )
 
-func createDB(db *sql.DB) error {
-	sqlStmt := `
-	CREATE TABLE nodes (
-		ID text not null, 
-		name text,
-		version_major number,
-		version_minor number,
-		version_patch number,
-		version_tag text,
-		version_build text,
-		version_date text,
-		os_name text,
-		os_architecture text,
-		language_name text,
-		language_version text,
-		last_crawled datetime,
-		country_name text,
-		PRIMARY KEY (ID)
-	);
-	delete from nodes;
-	`
-	_, err := db.Exec(sqlStmt)
-	return err
-}
+// defaultCrawlerID identifies observations of crawlers which don't report
+// an instance ID.
+const defaultCrawlerID = "default"
 
 func InsertCrawledNodes(db *sql.DB, crawledNodes []input.CrawledNode) error {
 	fmt.Printf("Writing nodes to db: %v\n", len(crawledNodes))
@@ -41,14 +21,200 @@ func InsertCrawledNodes(db *sql.DB, crawledNodes []input.CrawledNode) error {
 	if err != nil {
 		return err
 	}
+	if err := insertCrawledNodes(tx, crawledNodes); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	recordInsert(crawledNodes)
+	return nil
+}
+
+// syncCrawledNodes inserts the nodes read from a source and advances the
+// cursor of the source in the same transaction, so no node is skipped or
+// processed twice across restarts.
+func syncCrawledNodes(db *sql.DB, source string, cursor int64, crawledNodes []input.CrawledNode) error {
+	fmt.Printf("Writing nodes to db: %v\n", len(crawledNodes))
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := insertCrawledNodes(tx, crawledNodes); err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO sync_state(source, cursor) values(?,?) ON CONFLICT(source) DO UPDATE SET cursor=excluded.cursor`, source, cursor)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	recordInsert(crawledNodes)
+	return nil
+}
+
+// observationTime is the time a crawled node was probed. Every report of
+// older crawlers, which don't send the probe time, counts as an observation.
+func observationTime(node input.CrawledNode) int64 {
+	if node.LastProbe != 0 {
+		return node.LastProbe
+	}
+	return node.Now
+}
+
+// recordInsert updates the metrics after a batch of nodes was inserted.
+func recordInsert(crawledNodes []input.CrawledNode) {
+	metrics.NodesInserted.Add(float64(len(crawledNodes)))
+	var newest int64
+	for _, node := range crawledNodes {
+		if node.Now > newest {
+			newest = node.Now
+		}
+	}
+	if newest > 0 {
+		metrics.IngestionLag.Set(time.Since(time.Unix(newest, 0)).Seconds())
+	}
+}
+
+// readSyncCursor returns the position up to which the source was synced.
+func readSyncCursor(db *sql.DB, source string) (int64, error) {
+	var cursor int64
+	err := db.QueryRow(`SELECT cursor FROM sync_state WHERE source = ?`, source).Scan(&cursor)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return cursor, err
+}
+
+// resyncIfReset rewinds the sync cursor of the source when it is ahead of the
+// crawler database, which happens when the crawler database was recreated and
+// its row versions started over. It returns the cursor to read from.
+func resyncIfReset(crawlerDB, db *sql.DB, source string, cursor int64) (int64, error) {
+	last, err := input.LastRowVersion(crawlerDB)
+	if err != nil || cursor <= last {
+		return cursor, err
+	}
+	fmt.Printf("Sync cursor %d of %s is ahead of the crawler database at %d, resyncing\n", cursor, source, last)
+	_, err = db.Exec(`UPDATE sync_state SET cursor = 0 WHERE source = ?`, source)
+	if err != nil {
+		return cursor, err
+	}
+	return 0, nil
+}
+
+// insertCrawledNodes stores the observation of every node by its crawler and
+// merges the observations of all crawlers into the nodes table. Client info
+// is taken from the most recent crawler that reached the node, latency is the
+// lowest one measured by any crawler.
+func insertCrawledNodes(tx *sql.Tx, crawledNodes []input.CrawledNode) error {
+	vantageStmt, err := tx.Prepare(
+		`insert into node_vantages(
+			ID, crawler_id, last_seen, reachable, latency_ms,
+			client_type, client_version, os_type, go_version, country_name,
+			error_reason, error_string, fork_hash, fork_next, disconnect_reason,
+			head_number, head_time, eth_version, opera_version, head_verified)
+			values(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?) ON CONFLICT(ID, crawler_id) DO UPDATE SET
+			last_seen=excluded.last_seen,
+			reachable=excluded.reachable,
+			latency_ms=excluded.latency_ms,
+			client_type=excluded.client_type,
+			client_version=excluded.client_version,
+			os_type=excluded.os_type,
+			go_version=excluded.go_version,
+			country_name=excluded.country_name,
+			error_reason=excluded.error_reason,
+			error_string=excluded.error_string,
+			fork_hash=excluded.fork_hash,
+			fork_next=excluded.fork_next,
+			disconnect_reason=excluded.disconnect_reason,
+			head_number=excluded.head_number,
+			head_time=excluded.head_time,
+			eth_version=excluded.eth_version,
+			opera_version=excluded.opera_version,
+			head_verified=excluded.head_verified`)
+	if err != nil {
+		return err
+	}
+	defer vantageStmt.Close()
+
+	// Details are taken from the latest report, except for the client
+	// name which is only known after a successful Hello exchange.
+	detailsStmt, err := tx.Prepare(
+		`insert into node_details(
+			ID, hello_name, enr, seq, public_key, ip, tcp, udp,
+			capabilities, software_version, network_id, fork_hash, fork_next,
+			city, latitude, longitude, first_seen, last_seen, score,
+			error_reason, error_string)
+			values(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?) ON CONFLICT(ID) DO UPDATE SET
+			hello_name=CASE WHEN excluded.hello_name != '' THEN excluded.hello_name ELSE hello_name END,
+			enr=excluded.enr,
+			seq=excluded.seq,
+			public_key=excluded.public_key,
+			ip=excluded.ip,
+			tcp=excluded.tcp,
+			udp=excluded.udp,
+			capabilities=CASE WHEN excluded.capabilities != '' THEN excluded.capabilities ELSE capabilities END,
+			software_version=excluded.software_version,
+			network_id=excluded.network_id,
+			fork_hash=excluded.fork_hash,
+			fork_next=excluded.fork_next,
+			city=excluded.city,
+			latitude=excluded.latitude,
+			longitude=excluded.longitude,
+			first_seen=CASE WHEN first_seen IS NULL OR excluded.first_seen < first_seen THEN excluded.first_seen ELSE first_seen END,
+			last_seen=MAX(IFNULL(last_seen, 0), IFNULL(excluded.last_seen, 0)),
+			score=excluded.score,
+			error_reason=excluded.error_reason,
+			error_string=excluded.error_string`)
+	if err != nil {
+		return err
+	}
+	defer detailsStmt.Close()
+
+	// Replayed batches, and nodes carried over by the crawler without
+	// being probed again, report the same observations again.
+	observationStmt, err := tx.Prepare(
+		`insert or ignore into node_observations(
+			ID, crawler_id, timestamp, reachable, latency_ms, hello_name,
+			capabilities, network_id, fork_hash, fork_next, ip, score,
+			error_reason, error_string, disconnect_reason, head_number, head_time,
+			eth_version, opera_version, connect_ms, handshake_ms, hello_ms, status_ms, ping_ms, head_verified)
+			values(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`)
+	if err != nil {
+		return err
+	}
+	defer observationStmt.Close()
+
+	mergeStmt, err := tx.Prepare(
+		`SELECT client_type, client_version, os_type, go_version, country_name, error_reason, error_string,
+			IFNULL(fork_hash, ''), IFNULL(fork_next, 0), disconnect_reason,
+			IFNULL(head_number, 0), IFNULL(head_time, 0),
+			IFNULL(eth_version, 0), IFNULL(opera_version, 0), IFNULL(head_verified, 0),
+			(SELECT MAX(last_seen) FROM node_vantages WHERE ID = ?1),
+			(SELECT MAX(reachable) FROM node_vantages WHERE ID = ?1),
+			(SELECT MIN(latency_ms) FROM node_vantages WHERE ID = ?1 AND reachable),
+			(SELECT COUNT(*) FROM node_vantages WHERE ID = ?1)
+			FROM node_vantages WHERE ID = ?1 ORDER BY reachable DESC, last_seen DESC LIMIT 1`)
+	if err != nil {
+		return err
+	}
+	defer mergeStmt.Close()
+
 	stmt, err := tx.Prepare(
 		`insert into nodes(
 			ID, 
 			name, 
 			version_major, version_minor, version_patch, version_tag, version_build, version_date, 
 			os_name, os_architecture, 
-			language_name, language_version, last_crawled, country_name)
-			values(?,?,?,?,?,?,?,?,?,?,?,?,?,?) ON CONFLICT(ID) DO UPDATE SET 
+			language_name, language_version, last_crawled, country_name,
+			reachable, latency_ms, vantage_points, fork_hash, fork_next, error_reason, disconnect_reason,
+			head_number, head_time, eth_version, opera_version, head_verified)
+			values(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?) ON CONFLICT(ID) DO UPDATE SET 
 			name=excluded.name,
 			version_major=excluded.version_major,
 			version_minor=excluded.version_minor,
@@ -61,17 +227,147 @@ func InsertCrawledNodes(db *sql.DB, crawledNodes []input.CrawledNode) error {
 			language_name=excluded.language_name,
 			language_version=excluded.language_version,
 			last_crawled=excluded.last_crawled,
-			country_name=excluded.country_name
+			country_name=excluded.country_name,
+			reachable=excluded.reachable,
+			latency_ms=excluded.latency_ms,
+			vantage_points=excluded.vantage_points,
+			fork_hash=excluded.fork_hash,
+			fork_next=excluded.fork_next,
+			error_reason=excluded.error_reason,
+			disconnect_reason=excluded.disconnect_reason,
+			head_number=excluded.head_number,
+			head_time=excluded.head_time,
+			eth_version=excluded.eth_version,
+			opera_version=excluded.opera_version,
+			head_verified=excluded.head_verified
 			WHERE name=excluded.name OR excluded.name != "unknown"`)
 	if err != nil {
 		return err
 	}
+	defer stmt.Close()
 
 	for _, node := range crawledNodes {
-		parsed := parser.ParseVersionString(node.ClientType, node.ClientVersion, node.OsType, node.GoVersion)
+		crawlerID := node.CrawlerID
+		if crawlerID == "" {
+			crawlerID = defaultCrawlerID
+		}
+		_, err = vantageStmt.Exec(
+			node.ID,
+			crawlerID,
+			node.Now,
+			node.Reachable,
+			node.Latency,
+			node.ClientType,
+			node.ClientVersion,
+			node.OsType,
+			node.GoVersion,
+			node.Country,
+			node.ErrorReason,
+			node.ErrorString,
+			node.ForkHash,
+			node.ForkNext,
+			node.DisconnectReason,
+			nullNumber(node.HeadNumber),
+			nullUnix(node.HeadTime),
+			node.EthVersion,
+			node.OperaVersion,
+			node.HeadVerified,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = detailsStmt.Exec(
+			node.ID,
+			node.Name,
+			node.ENR,
+			node.Seq,
+			node.PublicKey,
+			node.IP,
+			node.TCP,
+			node.UDP,
+			node.Capabilities,
+			node.SoftwareVersion,
+			node.NetworkID,
+			node.ForkHash,
+			node.ForkNext,
+			node.City,
+			node.Latitude,
+			node.Longitude,
+			nullUnix(node.FirstSeen),
+			nullUnix(node.LastSeen),
+			node.Score,
+			node.ErrorReason,
+			node.ErrorString,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = observationStmt.Exec(
+			node.ID,
+			crawlerID,
+			observationTime(node),
+			node.Reachable,
+			node.Latency,
+			node.Name,
+			node.Capabilities,
+			node.NetworkID,
+			node.ForkHash,
+			node.ForkNext,
+			node.IP,
+			node.Score,
+			node.ErrorReason,
+			node.ErrorString,
+			node.DisconnectReason,
+			nullNumber(node.HeadNumber),
+			nullUnix(node.HeadTime),
+			node.EthVersion,
+			node.OperaVersion,
+			node.ConnectTime,
+			node.HandshakeTime,
+			node.HelloRTT,
+			node.StatusRTT,
+			node.PingRTT,
+			node.HeadVerified,
+		)
+		if err != nil {
+			return err
+		}
+
+		var (
+			merged             input.CrawledNode
+			lastSeen, vantages int64
+			reachable          bool
+			latency            sql.NullInt64
+		)
+		err = mergeStmt.QueryRow(node.ID).Scan(
+			&merged.ClientType,
+			&merged.ClientVersion,
+			&merged.OsType,
+			&merged.GoVersion,
+			&merged.Country,
+			&merged.ErrorReason,
+			&merged.ErrorString,
+			&merged.ForkHash,
+			&merged.ForkNext,
+			&merged.DisconnectReason,
+			&merged.HeadNumber,
+			&merged.HeadTime,
+			&merged.EthVersion,
+			&merged.OperaVersion,
+			&merged.HeadVerified,
+			&lastSeen,
+			&reachable,
+			&latency,
+			&vantages,
+		)
+		if err != nil {
+			return err
+		}
+
+		parsed := parser.ParseVersionString(merged.ClientType, merged.ClientVersion, merged.OsType, merged.GoVersion)
 		if parsed.Name == "NA" {
-			if node.ErrorReason == -1 {
-				parsed.Name = node.ErrorString
+			if merged.ErrorReason == -1 {
+				parsed.Name = merged.ErrorString
 			}
 		}
 		if parsed != nil {
@@ -88,15 +384,27 @@ func InsertCrawledNodes(db *sql.DB, crawledNodes []input.CrawledNode) error {
 				parsed.Os.Architecture,
 				parsed.Language.Name,
 				parsed.Language.Version,
-				time.Now(),
-				node.Country,
+				time.Unix(lastSeen, 0),
+				merged.Country,
+				reachable,
+				latency,
+				vantages,
+				merged.ForkHash,
+				merged.ForkNext,
+				merged.ErrorReason,
+				merged.DisconnectReason,
+				nullNumber(merged.HeadNumber),
+				nullUnix(merged.HeadTime),
+				merged.EthVersion,
+				merged.OperaVersion,
+				merged.HeadVerified,
 			)
 			if err != nil {
-				panic(err)
+				return err
 			}
 		}
 	}
-	return tx.Commit()
+	return nil
 }
 
 func dropOldNodes(db *sql.DB, minTimePassed time.Duration) error {
@@ -106,15 +414,56 @@ func dropOldNodes(db *sql.DB, minTimePassed time.Duration) error {
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM node_vantages WHERE last_seen < ?`, oldest.Unix()); err != nil {
+		return err
+	}
 	stmt, err := tx.Prepare(`DELETE FROM nodes WHERE last_crawled < ?`)
 	if err != nil {
 		return err
 	}
+	defer stmt.Close()
 	res, err := stmt.Exec(oldest)
 	if err != nil {
 		return err
 	}
+	if _, err := tx.Exec(`DELETE FROM node_details WHERE ID NOT IN (SELECT ID FROM nodes)`); err != nil {
+		return err
+	}
 	affected, _ := res.RowsAffected()
 	fmt.Printf("Dropped %v nodes\n", affected)
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	metrics.NodesDropped.Add(float64(affected))
+	return nil
+}
+
+// dropOldObservations deletes the observation history older than the
+// retention period.
+func dropOldObservations(db *sql.DB, retention time.Duration) error {
+	oldest := time.Now().Add(-retention)
+	res, err := db.Exec(`DELETE FROM node_observations WHERE timestamp < ?`, oldest.Unix())
+	if err != nil {
+		return err
+	}
+	affected, _ := res.RowsAffected()
+	fmt.Printf("Dropped %v observations\n", affected)
+	return nil
+}
+
+// nullNumber maps zero to NULL.
+func nullNumber(n uint64) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+// nullUnix maps the zero timestamp to NULL.
+func nullUnix(t int64) interface{} {
+	if t == 0 {
+		return nil
+	}
+	return t
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/MariusVanDerWijden/node-crawler-backend/input"
+)
+
+func TestSyncCrawledNodes(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	nodes := []input.CrawledNode{
+		{ID: "a", RowVersion: 1, ClientType: "go-opera", ClientVersion: "v1.1.0-rc.4", Now: 1},
+		{ID: "b", RowVersion: 2, ClientType: "go-opera", ClientVersion: "v1.0.2", Now: 1},
+	}
+	if err := syncCrawledNodes(db, "test", 2, nodes); err != nil {
+		t.Fatal(err)
+	}
+	// replaying a batch must not duplicate nodes
+	if err := syncCrawledNodes(db, "test", 2, nodes[1:]); err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := readSyncCursor(db, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != 2 {
+		t.Fatalf("wrong cursor: got %d, want 2", cursor)
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM nodes`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("wrong node count: got %d, want 2", count)
+	}
+}
+
+func TestMergeVantagePoints(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	// eu reaches the node, us doesn't; the later failed probe must not
+	// override the client info seen by eu.
+	nodes := []input.CrawledNode{
+		{ID: "a", CrawlerID: "eu", Name: "go-opera/v1.1.0-rc.4/linux-amd64/go1.17", ClientType: "go-opera", ClientVersion: "v1.1.0-rc.4", Now: 1, Reachable: true, Latency: 80},
+		{ID: "a", CrawlerID: "us", Now: 2, ErrorReason: -1, ErrorString: "dial"},
+	}
+	if err := InsertCrawledNodes(db, nodes); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		name              string
+		reachable         bool
+		latency, vantages int
+	)
+	err := db.QueryRow(`SELECT name, reachable, latency_ms, vantage_points FROM nodes WHERE ID = 'a'`).Scan(&name, &reachable, &latency, &vantages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "go-opera" || !reachable || latency != 80 || vantages != 2 {
+		t.Fatalf("wrong merged node: name %q, reachable %v, latency %d, vantage points %d", name, reachable, latency, vantages)
+	}
+
+	var helloName string
+	if err := db.QueryRow(`SELECT hello_name FROM node_details WHERE ID = 'a'`).Scan(&helloName); err != nil {
+		t.Fatal(err)
+	}
+	if helloName != nodes[0].Name {
+		t.Fatalf("wrong hello name: got %q, want %q", helloName, nodes[0].Name)
+	}
+	var observations int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM node_observations WHERE ID = 'a'`).Scan(&observations); err != nil {
+		t.Fatal(err)
+	}
+	if observations != 2 {
+		t.Fatalf("wrong observation count: got %d, want 2", observations)
+	}
+}
+
+func TestResyncIfReset(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	crawlerDB := openTestDB(t)
+	if _, err := crawlerDB.Exec(`CREATE TABLE nodes (ID text, RowVersion number)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO sync_state(source, cursor) values('test', 5)`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rows       string
+		cursor     int64
+		wantCursor int64
+	}{
+		{rows: `('a', 5), ('b', 6)`, cursor: 5, wantCursor: 5}, // behind, nothing to do
+		{rows: `('a', 5)`, cursor: 5, wantCursor: 5},           // up to date
+		{rows: `('a', 1), ('b', 2)`, cursor: 5, wantCursor: 0}, // recreated
+		{rows: ``, cursor: 5, wantCursor: 0},                   // recreated and empty
+	}
+	for _, test := range tests {
+		if _, err := crawlerDB.Exec(`DELETE FROM nodes`); err != nil {
+			t.Fatal(err)
+		}
+		if test.rows != "" {
+			if _, err := crawlerDB.Exec(`INSERT INTO nodes(ID, RowVersion) values` + test.rows); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := db.Exec(`UPDATE sync_state SET cursor = ? WHERE source = 'test'`, test.cursor); err != nil {
+			t.Fatal(err)
+		}
+		cursor, err := resyncIfReset(crawlerDB, db, "test", test.cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := readSyncCursor(db, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cursor != test.wantCursor || stored != test.wantCursor {
+			t.Errorf("rows %s: got cursor %d, stored %d, want %d", test.rows, cursor, stored, test.wantCursor)
+		}
+	}
+}
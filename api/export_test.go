@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/MariusVanDerWijden/node-crawler-backend/input"
+)
+
+var exportNodes = []input.CrawledNode{
+	{
+		ID: "a", CrawlerID: "eu", Now: 100, LastProbe: 90, Reachable: true, Latency: 80,
+		Name: "go-opera/v1.1.0-rc.4/linux-amd64/go1.17", ClientType: "go-opera", ClientVersion: "v1.1.0-rc.4",
+		OsType: "linux-amd64", ForkHash: "0xfc64ec04", ForkNext: 1150000, HeadNumber: 900, HeadTime: 90, HeadVerified: true,
+	},
+	{ID: "b", CrawlerID: "eu", Now: 100, LastProbe: 95, ErrorReason: 1, ErrorString: "dial tcp: i/o timeout", HeadNumber: 1000, HeadVerified: true},
+	// an unverified head doesn't count
+	{ID: "c", CrawlerID: "eu", Now: 100, LastProbe: 95, HeadNumber: 5000},
+}
+
+func getExport(t *testing.T, format, filter string) *http.Response {
+	t.Helper()
+	srv := newTestServer(t, exportNodes)
+	query := url.Values{"format": {format}}
+	if filter != "" {
+		query.Set("filter", filter)
+	}
+	resp, err := http.Get(srv.URL + "/v1/export?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	return resp
+}
+
+func TestExportCSV(t *testing.T) {
+	resp := getExport(t, "csv", "")
+	if ct := resp.Header.Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("wrong content type %q", ct)
+	}
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("got %d records, want header and 3 nodes", len(records))
+	}
+	column := make(map[string]int)
+	for i, name := range records[0] {
+		column[name] = i
+	}
+	want := []map[string]string{
+		{"id": "a", "name": "go-opera", "version": "1.1.0-rc.4", "reachable": "true", "latency": "80",
+			"forkHash": "0xfc64ec04", "forkNext": "1150000", "errorReason": "0", "headNumber": "900", "blocksBehind": "100"},
+		{"id": "b", "reachable": "false", "latency": "", "errorReason": "1", "errorString": "dial tcp: i/o timeout",
+			"headNumber": "1000", "headVerified": "true", "blocksBehind": "0"},
+		{"id": "c", "headNumber": "5000", "headVerified": "false", "blocksBehind": ""},
+	}
+	for i, fields := range want {
+		for name, value := range fields {
+			idx, ok := column[name]
+			if !ok {
+				t.Fatalf("no column %q", name)
+			}
+			if got := records[i+1][idx]; got != value {
+				t.Errorf("node %d: %v = %q, want %q", i, name, got, value)
+			}
+		}
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	resp := getExport(t, "ndjson", `[["name:go-opera"]]`)
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("wrong content type %q", ct)
+	}
+	var rows []map[string]interface{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var row map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("got %d nodes, want the go-opera one", len(rows))
+	}
+	row := rows[0]
+	want := map[string]interface{}{
+		"id": "a", "reachable": true, "latency": 80.0, "osName": "linux", "forkHash": "0xfc64ec04",
+		"errorClass": "none", "headNumber": 900.0, "headVerified": true, "blocksBehind": 100.0, "disconnectReason": nil,
+	}
+	for key, value := range want {
+		got, ok := row[key]
+		if !ok {
+			t.Errorf("no key %q", key)
+		} else if got != value {
+			t.Errorf("%v = %v, want %v", key, got, value)
+		}
+	}
+	for key := range row {
+		for _, c := range key {
+			if c == '_' {
+				t.Errorf("key %q isn't camelCase", key)
+			}
+		}
+	}
+}
@@ -6,4 +6,5 @@ require (
 	github.com/gorilla/mux v1.8.0
 	github.com/hashicorp/golang-lru v0.5.4
 	github.com/mattn/go-sqlite3 v1.14.7
+	github.com/prometheus/client_golang v1.11.1
 )
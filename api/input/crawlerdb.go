@@ -2,44 +2,109 @@ package input
 
 import (
 	"database/sql"
-	"time"
 )
 
+// CrawledNode is a node as reported by the crawler. The JSON encoding is
+// the format of the ingestion endpoint.
 type CrawledNode struct {
-	ID              string
-	Now             string
-	ClientType      string
-	ClientVersion   string
-	ClientDesc      string
-	OsType          string
-	GoVersion       string
-	SoftwareVersion uint64
-	Capabilities    string
-	NetworkID       uint64
-	Country		    string
-	ForkID          string
-	ErrorReason     int
-	ErrorString     string
+	ID              string `json:"id"`
+	RowVersion      int64  `json:"-"`
+	Now             int64  `json:"now"` // unix timestamp
+	ClientType      string `json:"clientType"`
+	ClientVersion   string `json:"clientVersion"`
+	ClientDesc      string `json:"clientDesc"`
+	OsType          string `json:"osType"`
+	GoVersion       string `json:"goVersion"`
+	SoftwareVersion uint64 `json:"softwareVersion"`
+	Capabilities    string `json:"capabilities"` // comma separated, e.g. "eth/66,opera/63"
+	NetworkID       uint64 `json:"networkId"`
+	Country         string `json:"country"`
+	ForkHash        string `json:"forkHash"`
+	ForkNext        uint64 `json:"forkNext"`
+	ErrorReason     int    `json:"errorReason"`
+	ErrorString     string `json:"errorString"`
+	CrawlerID       string `json:"crawlerId"`
+	Reachable       bool   `json:"reachable"`
+	Latency         int64  `json:"latency"` // milliseconds
+
+	// Raw data of the node, shown in its details.
+	Name      string   `json:"name"` // client name from the Hello message
+	ENR       string   `json:"enr"`
+	Seq       uint64   `json:"seq"`
+	PublicKey string   `json:"publicKey"`
+	IP        string   `json:"ip"`
+	TCP       int      `json:"tcp"`
+	UDP       int      `json:"udp"`
+	City      string   `json:"city"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	FirstSeen int64    `json:"firstSeen"` // unix timestamp, 0 if never reached
+	LastSeen  int64    `json:"lastSeen"`
+	Score     int      `json:"score"`
+	// DisconnectReason is the p2p disconnect reason sent by the node
+	// during the probe, nil if it didn't disconnect.
+	DisconnectReason *int `json:"disconnectReason"`
+	// HeadNumber and HeadTime describe the head block of the node, 0 if
+	// unknown. HeadVerified is set if the crawler verified the head.
+	HeadNumber   uint64 `json:"headNumber"`
+	HeadTime     int64  `json:"headTime"` // unix timestamp
+	HeadVerified bool   `json:"headVerified"`
+	// EthVersion and OperaVersion are the protocol versions negotiated
+	// with the node, 0 if none.
+	EthVersion   uint `json:"ethVersion"`
+	OperaVersion uint `json:"operaVersion"`
+	// Durations of the probe stages in milliseconds, nil if a stage
+	// wasn't reached.
+	ConnectTime   *float64 `json:"connectTime"`
+	HandshakeTime *float64 `json:"handshakeTime"`
+	HelloRTT      *float64 `json:"helloRtt"`
+	StatusRTT     *float64 `json:"statusRtt"`
+	PingRTT       *float64 `json:"pingRtt"`
+	// LastProbe is the unix timestamp of the probe the fields above were
+	// measured by, 0 if unknown.
+	LastProbe int64 `json:"lastProbe"`
 }
 
-func ReadRecentNodes(db *sql.DB, lastCheck time.Time) ([]CrawledNode, error) {
-	queryStmt := "SELECT ID, Now, ClientType, ClientVersion, ClientDesc, OsType, GoVersion, SoftwareVersion, Capabilities, NetworkID, Country, " +
-		"ForkID, ErrorReason, ErrorString FROM nodes WHERE Now > ?"
-	// TODO do a proper check here ^
-	rows, err := db.Query(queryStmt, lastCheck.String())
+// LastRowVersion returns the highest row version in the crawler database, 0
+// if it has no nodes.
+func LastRowVersion(db *sql.DB) (int64, error) {
+	var rowVersion int64
+	err := db.QueryRow(`SELECT IFNULL(MAX(RowVersion), 0) FROM nodes`).Scan(&rowVersion)
+	return rowVersion, err
+}
 
+// ReadNodesSince returns up to limit nodes written by the crawler after the
+// given row version, ordered by row version. The row version of the last
+// node is the cursor for the next call.
+func ReadNodesSince(db *sql.DB, rowVersion int64, limit int) ([]CrawledNode, error) {
+	queryStmt := "SELECT ID, RowVersion, Now, ClientType, ClientVersion, ClientDesc, OsType, GoVersion, SoftwareVersion, " +
+		"IFNULL((SELECT group_concat(Name || '/' || Version) FROM node_capabilities WHERE NodeID = nodes.ID), ''), " +
+		"NetworkID, Country, IFNULL(ForkHash, ''), IFNULL(ForkNext, 0), ErrorReason, ErrorString, " +
+		"IFNULL(CrawlerID, ''), IFNULL(Reachable, ErrorReason = 0), IFNULL(Latency, 0), " +
+		"IFNULL(Name, ''), IFNULL(ENR, ''), IFNULL(Seq, 0), IFNULL(PK, ''), IFNULL(IP, ''), IFNULL(TCP, 0), IFNULL(UDP, 0), " +
+		"IFNULL(City, ''), Latitude, Longitude, IFNULL(FirstSeen, 0), IFNULL(LastSeen, 0), IFNULL(Score, 0), DisconnectReason, " +
+		"IFNULL(CAST(NULLIF(Blockheight, '') AS INTEGER), 0), IFNULL(HeadTime, 0), " +
+		"IFNULL(EthVersion, 0), IFNULL(OperaVersion, 0), " +
+		"ConnectTime, HandshakeTime, HelloRTT, StatusRTT, PingRTT, IFNULL(LastProbe, 0), IFNULL(HeadVerified, 0) FROM nodes " +
+		"WHERE RowVersion > ? ORDER BY RowVersion LIMIT ?"
+	rows, err := db.Query(queryStmt, rowVersion, limit)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	var nodes []CrawledNode
 	for rows.Next() {
 		var node CrawledNode
-		err = rows.Scan(&node.ID, &node.Now, &node.ClientType, &node.ClientVersion, &node.ClientDesc, &node.OsType, &node.GoVersion, &node.SoftwareVersion, &node.Capabilities, &node.NetworkID, &node.Country, &node.ForkID, &node.ErrorReason, &node.ErrorString)
+		err = rows.Scan(&node.ID, &node.RowVersion, &node.Now, &node.ClientType, &node.ClientVersion, &node.ClientDesc, &node.OsType, &node.GoVersion, &node.SoftwareVersion, &node.Capabilities, &node.NetworkID, &node.Country, &node.ForkHash, &node.ForkNext, &node.ErrorReason, &node.ErrorString, &node.CrawlerID, &node.Reachable, &node.Latency,
+			&node.Name, &node.ENR, &node.Seq, &node.PublicKey, &node.IP, &node.TCP, &node.UDP,
+			&node.City, &node.Latitude, &node.Longitude, &node.FirstSeen, &node.LastSeen, &node.Score, &node.DisconnectReason,
+			&node.HeadNumber, &node.HeadTime, &node.EthVersion, &node.OperaVersion,
+			&node.ConnectTime, &node.HandshakeTime, &node.HelloRTT, &node.StatusRTT, &node.PingRTT, &node.LastProbe, &node.HeadVerified)
 		if err != nil {
 			return nil, err
 		}
 		nodes = append(nodes, node)
 	}
-	return nodes, nil
+	return nodes, rows.Err()
 }
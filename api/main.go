@@ -4,50 +4,64 @@ import (
 	"database/sql"
 	"flag"
 	"fmt"
-	"os"
 	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/MariusVanDerWijden/node-crawler-backend/api"
 	"github.com/MariusVanDerWijden/node-crawler-backend/input"
 )
 
 var (
-	crawlerDBPath = flag.String("crawler-db-path", "operadb.sqlite", "Crawler Database SQLite Path")
+	crawlerDBPath = flag.String("crawler-db-path", "operadb.sqlite", "Crawler Database SQLite Path, set to empty to only ingest pushed nodes")
 	apiDBPath     = flag.String("api-db-path", "apidb.sqlite", "API Database SQLite Path")
 	dropNodesTime = flag.Duration("drop-time", 24*time.Hour, "Time to drop crawled nodes")
+	historyTime   = flag.Duration("history-time", 30*24*time.Hour, "Time to keep the observation history of nodes")
+	snapshotTime  = flag.Duration("snapshot-interval", time.Hour, "Interval between snapshots of the node counts for /v1/timeseries")
+	snapshotKeep  = flag.Duration("snapshot-time", 365*24*time.Hour, "Time to keep the snapshots of the node counts")
+	forkBlock     = flag.Uint64("fork-block", 0, "Block of the upcoming network upgrade, nodes announcing it in their fork ID are ready")
+	forkGenesis   = flag.String("fork-genesis", "", "Hash of the genesis block of the eth fork IDs, to recognize nodes past the upgrade")
+	forks         = flag.String("forks", "", "Comma separated fork blocks of the chain config, to recognize nodes past the upgrade")
+	minVersions   = flag.String("min-client-version", "", "Comma separated client/version pairs supporting the upcoming upgrade, e.g. go-opera/1.1.1")
+	ingestToken   = flag.String("ingest-token", "", "Bearer token for crawlers pushing nodes to /v1/ingest, ingestion is disabled if empty")
 )
 
 func main() {
 	flag.Parse()
 
-	crawlerDB, err := sql.Open("sqlite3", *crawlerDBPath)
+	nodeDB, err := sql.Open("sqlite3", *apiDBPath)
 	if err != nil {
 		panic(err)
 	}
-	shouldInit := false
-	if _, err := os.Stat(*apiDBPath); os.IsNotExist(err) {
-		shouldInit = true
-	}
-	nodeDB, err := sql.Open("sqlite3", *apiDBPath)
-	if err != nil {
+	if err := migrateDB(nodeDB); err != nil {
 		panic(err)
 	}
-	if shouldInit {
-		fmt.Println("DB did not exist, init")
-		if err := createDB(nodeDB); err != nil {
+	prometheus.MustRegister(newNodeCollector(nodeDB))
+	var wg sync.WaitGroup
+	// Start reading deamon, unless the crawlers push their nodes
+	if *crawlerDBPath != "" {
+		crawlerDB, err := sql.Open("sqlite3", *crawlerDBPath)
+		if err != nil {
 			panic(err)
 		}
+		wg.Add(1)
+		go newNodeDeamon(&wg, crawlerDB, nodeDB)
 	}
-	var wg sync.WaitGroup
 	wg.Add(3)
-	// Start reading deamon
-	go newNodeDeamon(&wg, crawlerDB, nodeDB)
 	go dropDeamon(&wg, nodeDB)
+	go snapshotDeamon(&wg, nodeDB, *snapshotTime)
 	// Start the API deamon
 	apiDeamon := api.New(nodeDB)
+	if err := apiDeamon.SetReadiness(*forkBlock, *forkGenesis, *forks, *minVersions); err != nil {
+		panic(err)
+	}
+	if *ingestToken != "" {
+		apiDeamon.EnableIngestion(*ingestToken, func(nodes []input.CrawledNode) error {
+			return InsertCrawledNodes(nodeDB, nodes)
+		})
+	}
 	go apiDeamon.HandleRequests(&wg)
 	wg.Wait()
 }
@@ -56,23 +70,62 @@ func main() {
 // Might trigger the invalidation of caches for the api in the future
 func newNodeDeamon(wg *sync.WaitGroup, crawlerDB, nodeDB *sql.DB) {
 	defer wg.Done()
-	lastCheck := time.Time{}
+	const (
+		source    = "crawler-db"
+		batchSize = 1000
+	)
+	backoff := time.Duration(0)
 	for {
-		nodes, err := input.ReadRecentNodes(crawlerDB, lastCheck)
+		if backoff > 0 {
+			time.Sleep(backoff)
+		}
+		cursor, err := readSyncCursor(nodeDB, source)
+		if err != nil {
+			fmt.Printf("Error reading sync cursor: %v\n", err)
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		nodes, err := input.ReadNodesSince(crawlerDB, cursor, batchSize)
 		if err != nil {
 			fmt.Printf("Error reading nodes: %v\n", err)
-			return
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		if len(nodes) == 0 && cursor > 0 {
+			// Nothing new, check the crawler database wasn't recreated.
+			if _, err := resyncIfReset(crawlerDB, nodeDB, source, cursor); err != nil {
+				fmt.Printf("Error checking sync cursor: %v\n", err)
+				backoff = nextBackoff(backoff)
+				continue
+			}
 		}
-		lastCheck = time.Now()
 		if len(nodes) > 0 {
-			err := InsertCrawledNodes(nodeDB, nodes)
-			if err != nil {
+			cursor = nodes[len(nodes)-1].RowVersion
+			if err := syncCrawledNodes(nodeDB, source, cursor, nodes); err != nil {
 				fmt.Printf("Error inserting nodes: %v\n", err)
+				backoff = nextBackoff(backoff)
+				continue
 			}
 			fmt.Printf("%d nodes inserted\n", len(nodes))
 		}
-		time.Sleep(time.Second)
+		backoff = 0
+		// Read the next batch right away while catching up.
+		if len(nodes) < batchSize {
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// nextBackoff doubles the retry delay, starting at one second and capped
+// at one minute.
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return time.Second
+	}
+	if backoff *= 2; backoff > time.Minute {
+		return time.Minute
 	}
+	return backoff
 }
 
 func dropDeamon(wg *sync.WaitGroup, db *sql.DB) {
@@ -85,5 +138,11 @@ func dropDeamon(wg *sync.WaitGroup, db *sql.DB) {
 		if err != nil {
 			panic(err)
 		}
+		if err := dropOldObservations(db, *historyTime); err != nil {
+			panic(err)
+		}
+		if err := dropOldSnapshots(db, *snapshotKeep); err != nil {
+			panic(err)
+		}
 	}
 }
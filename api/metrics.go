@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// nodeCollector reports the number of nodes by client, counted when the
+// metrics are scraped.
+type nodeCollector struct {
+	db    *sql.DB
+	nodes *prometheus.Desc
+}
+
+func newNodeCollector(db *sql.DB) *nodeCollector {
+	return &nodeCollector{
+		db: db,
+		nodes: prometheus.NewDesc("api_nodes", "Number of nodes by client.",
+			[]string{"client"}, nil),
+	}
+}
+
+func (c *nodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.nodes
+}
+
+func (c *nodeCollector) Collect(ch chan<- prometheus.Metric) {
+	rows, err := c.db.Query(`SELECT IFNULL(name, ''), COUNT(*) FROM nodes GROUP BY name`)
+	if err != nil {
+		fmt.Printf("Error counting nodes: %v\n", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			name  string
+			count int
+		)
+		if err := rows.Scan(&name, &count); err != nil {
+			fmt.Printf("Error counting nodes: %v\n", err)
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(c.nodes, prometheus.GaugeValue, float64(count), name)
+	}
+}
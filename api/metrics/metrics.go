@@ -0,0 +1,48 @@
+// Package metrics holds the Prometheus metrics of the API service.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// Requests counts the handled requests by route and status code.
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_requests_total",
+		Help: "Number of handled requests.",
+	}, []string{"route", "code"})
+
+	// RequestDuration is the latency of the requests by route.
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "api_request_duration_seconds",
+		Help:    "Latency of the handled requests.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+
+	// CacheRequests counts lookups of the dashboard query cache by result,
+	// hit or miss.
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_cache_requests_total",
+		Help: "Number of dashboard query cache lookups.",
+	}, []string{"result"})
+
+	// IngestionLag is the time between the crawler checking the newest
+	// node of the last inserted batch and its insertion.
+	IngestionLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "api_ingestion_lag_seconds",
+		Help: "Age of the newest node of the last inserted batch.",
+	})
+
+	// NodesInserted counts the crawled nodes written to the database.
+	NodesInserted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "api_nodes_inserted_total",
+		Help: "Number of crawled nodes inserted or updated.",
+	})
+
+	// NodesDropped counts the nodes deleted for not being crawled recently.
+	NodesDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "api_nodes_dropped_total",
+		Help: "Number of nodes dropped for not being crawled recently.",
+	})
+)
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migration upgrades the database schema by one version.
+type migration func(tx *sql.Tx) error
+
+// migrations are applied in order. The schema version of a database is the
+// number of migrations applied to it. Migrations must be idempotent, as
+// databases created before versioning start at version zero.
+var migrations = []migration{
+	createNodesTable,
+	createSyncStateTable,
+	createVantageTable,
+	createNodeDetailsTables,
+	createSnapshotTables,
+	addForkIDColumns,
+	addErrorReasonColumn,
+	addDisconnectReasonColumns,
+	addHeadColumns,
+	addProtocolVersionColumns,
+	addTimingColumns,
+	addHeadVerifiedColumns,
+}
+
+// migrateDB brings the database schema up to date.
+func migrateDB(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version number not null)`); err != nil {
+		return err
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, len(migrations))
+	}
+	for ; version < len(migrations); version++ {
+		fmt.Printf("Migrating database from version %d to %d\n", version, version+1)
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := migrations[version](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration to version %d failed: %v", version+1, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM schema_version`); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_version(version) values(?)`, version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+// addColumn adds a column to a table unless it already exists.
+func addColumn(tx *sql.Tx, table, column, typ string) error {
+	rows, err := tx.Query(fmt.Sprintf(`SELECT name FROM pragma_table_info('%s')`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, typ))
+	return err
+}
+
+func createNodesTable(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS nodes (
+		ID text not null, 
+		name text,
+		version_major number,
+		version_minor number,
+		version_patch number,
+		version_tag text,
+		version_build text,
+		version_date text,
+		os_name text,
+		os_architecture text,
+		language_name text,
+		language_version text,
+		last_crawled datetime,
+		country_name text,
+		PRIMARY KEY (ID)
+	);
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+func createSyncStateTable(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS sync_state (
+		source text not null,
+		cursor number not null,
+		PRIMARY KEY (source)
+	);
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+// createVantageTable stores the observations of every crawler instance, the
+// nodes table holds the merged view.
+func createVantageTable(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS node_vantages (
+		ID text not null,
+		crawler_id text not null,
+		last_seen number not null,
+		reachable number,
+		latency_ms number,
+		client_type text,
+		client_version text,
+		os_type text,
+		go_version text,
+		country_name text,
+		error_reason number,
+		error_string text,
+		PRIMARY KEY (ID, crawler_id)
+	);
+	CREATE INDEX IF NOT EXISTS node_vantages_crawler ON node_vantages(crawler_id);
+	`
+	if _, err := tx.Exec(sqlStmt); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "nodes", "reachable", "number"); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "nodes", "latency_ms", "number"); err != nil {
+		return err
+	}
+	return addColumn(tx, "nodes", "vantage_points", "number")
+}
+
+// createNodeDetailsTables stores the raw data of every node and the history
+// of its observations.
+func createNodeDetailsTables(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS node_details (
+		ID text not null,
+		hello_name text,
+		enr text,
+		seq number,
+		public_key text,
+		ip text,
+		tcp number,
+		udp number,
+		capabilities text,
+		software_version number,
+		network_id number,
+		fork_hash text,
+		fork_next number,
+		city text,
+		latitude real,
+		longitude real,
+		first_seen number,
+		last_seen number,
+		score number,
+		error_reason number,
+		error_string text,
+		PRIMARY KEY (ID)
+	);
+	CREATE TABLE IF NOT EXISTS node_observations (
+		ID text not null,
+		crawler_id text not null,
+		timestamp number not null,
+		reachable number,
+		latency_ms number,
+		hello_name text,
+		capabilities text,
+		network_id number,
+		fork_hash text,
+		fork_next number,
+		ip text,
+		score number,
+		error_reason number,
+		error_string text,
+		PRIMARY KEY (ID, timestamp, crawler_id)
+	);
+	CREATE INDEX IF NOT EXISTS node_observations_timestamp ON node_observations(timestamp);
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+// createSnapshotTables stores the periodic snapshots of the node counts
+// shown on the dashboard.
+func createSnapshotTables(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS snapshots (
+		timestamp number not null,
+		PRIMARY KEY (timestamp)
+	);
+	CREATE TABLE IF NOT EXISTS snapshot_counts (
+		timestamp number not null,
+		dimension text not null,
+		name text not null,
+		nodes number not null,
+		reachable number not null,
+		PRIMARY KEY (dimension, timestamp, name)
+	);
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+// addForkIDColumns stores the fork ID of every node, which tells whether it
+// is ready for an upcoming network upgrade.
+func addForkIDColumns(tx *sql.Tx) error {
+	for _, table := range []string{"nodes", "node_vantages"} {
+		if err := addColumn(tx, table, "fork_hash", "text"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, table, "fork_next", "number"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addErrorReasonColumn stores the class of the last probe failure of every
+// node, zero if the probe succeeded.
+func addErrorReasonColumn(tx *sql.Tx) error {
+	return addColumn(tx, "nodes", "error_reason", "number")
+}
+
+// addDisconnectReasonColumns stores the p2p disconnect reason sent by a node
+// during a probe, NULL if it didn't disconnect.
+func addDisconnectReasonColumns(tx *sql.Tx) error {
+	for _, table := range []string{"nodes", "node_vantages", "node_observations"} {
+		if err := addColumn(tx, table, "disconnect_reason", "number"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addHeadColumns stores the number and timestamp of the head block served by
+// a node, NULL if it is unknown.
+func addHeadColumns(tx *sql.Tx) error {
+	for _, table := range []string{"nodes", "node_vantages", "node_observations"} {
+		if err := addColumn(tx, table, "head_number", "number"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, table, "head_time", "number"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addProtocolVersionColumns stores the eth and opera protocol versions the
+// crawler negotiated with a node, 0 if they share none.
+func addProtocolVersionColumns(tx *sql.Tx) error {
+	for _, table := range []string{"nodes", "node_vantages", "node_observations"} {
+		if err := addColumn(tx, table, "eth_version", "number"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, table, "opera_version", "number"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTimingColumns stores the durations of the probe stages of every
+// observation in milliseconds, NULL if a stage wasn't reached.
+func addTimingColumns(tx *sql.Tx) error {
+	for _, column := range []string{"connect_ms", "handshake_ms", "hello_ms", "status_ms", "ping_ms"} {
+		if err := addColumn(tx, "node_observations", column, "number"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addHeadVerifiedColumns tells whether the crawler verified the head of a
+// node. Only verified heads count towards the highest head.
+func addHeadVerifiedColumns(tx *sql.Tx) error {
+	for _, table := range []string{"nodes", "node_vantages", "node_observations"} {
+		if err := addColumn(tx, table, "head_verified", "number"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: opens a new database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrateDB(t *testing.T) {
+	db := openTestDB(t)
+	for i := 0; i < 2; i++ {
+		if err := migrateDB(db); err != nil {
+			t.Fatalf("migration %d failed: %v", i, err)
+		}
+		version, err := schemaVersion(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != len(migrations) {
+			t.Fatalf("wrong schema version: got %d, want %d", version, len(migrations))
+		}
+	}
+}
+
+func TestMigrateLegacyDB(t *testing.T) {
+	db := openTestDB(t)
+	// databases created before versioning only have the nodes table
+	if _, err := db.Exec(`CREATE TABLE nodes (ID text not null, name text, last_crawled datetime, PRIMARY KEY (ID))`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO nodes(ID, name) values('a', 'go-opera')`); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	if err := db.QueryRow(`SELECT name FROM nodes WHERE ID = 'a'`).Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	if name != "go-opera" {
+		t.Fatalf("data lost during migration: got %q", name)
+	}
+}
+
+func TestMigrateNewerDB(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE schema_version SET version = ?`, len(migrations)+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDB(db); err == nil {
+		t.Fatal("expected error for newer schema version")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/MariusVanDerWijden/node-crawler-backend/api"
+	"github.com/MariusVanDerWijden/node-crawler-backend/input"
+)
+
+// nodeResponse holds the parts of /v1/nodes/{id} checked by the tests.
+type nodeResponse struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Reachable     bool   `json:"reachable"`
+	VantagePoints int    `json:"vantagePoints"`
+	HelloName     string `json:"helloName"`
+	ForkID        struct {
+		Hash string `json:"hash"`
+		Next uint64 `json:"next"`
+	} `json:"forkId"`
+	Head *struct {
+		Number       uint64  `json:"number"`
+		Verified     bool    `json:"verified"`
+		BlocksBehind *uint64 `json:"blocksBehind"`
+	} `json:"head"`
+	LastError *struct {
+		Reason  int    `json:"reason"`
+		Message string `json:"message"`
+	} `json:"lastError"`
+	History []struct {
+		Timestamp time.Time `json:"timestamp"`
+		CrawlerID string    `json:"crawlerId"`
+		Reachable bool      `json:"reachable"`
+	} `json:"history"`
+}
+
+func newTestServer(t *testing.T, nodes []input.CrawledNode) *httptest.Server {
+	t.Helper()
+	db := openTestDB(t)
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertCrawledNodes(db, nodes); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(api.New(db).Handler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func getNode(t *testing.T, srv *httptest.Server, path string) (*nodeResponse, int) {
+	t.Helper()
+	resp, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode
+	}
+	var node nodeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&node); err != nil {
+		t.Fatal(err)
+	}
+	return &node, resp.StatusCode
+}
+
+func TestHandleNode(t *testing.T) {
+	srv := newTestServer(t, []input.CrawledNode{
+		{
+			ID: "a", CrawlerID: "eu", Now: 100, LastProbe: 90, Reachable: true, Latency: 80,
+			Name: "go-opera/v1.1.0-rc.4/linux-amd64/go1.17", ClientType: "go-opera", ClientVersion: "v1.1.0-rc.4",
+			ForkHash: "0xfc64ec04", ForkNext: 1150000, HeadNumber: 900, HeadTime: 90, HeadVerified: true,
+		},
+		{ID: "a", CrawlerID: "us", Now: 110, LastProbe: 105, ForkHash: "0xfc64ec04", ForkNext: 1150000, ErrorReason: 1, ErrorString: "dial tcp: i/o timeout"},
+		{ID: "b", CrawlerID: "eu", Now: 100, LastProbe: 95, Reachable: true, ClientType: "go-opera", HeadNumber: 1000, HeadTime: 95, HeadVerified: true},
+		// an unverified head doesn't count
+		{ID: "c", CrawlerID: "eu", Now: 100, LastProbe: 95, Reachable: true, ClientType: "go-opera", HeadNumber: 5000, HeadTime: 99},
+	})
+
+	node, status := getNode(t, srv, "/v1/nodes/a")
+	if status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if node.ID != "a" || !node.Reachable || node.VantagePoints != 2 || node.HelloName != "go-opera/v1.1.0-rc.4/linux-amd64/go1.17" {
+		t.Errorf("wrong node: %+v", node)
+	}
+	if node.ForkID.Hash != "0xfc64ec04" || node.ForkID.Next != 1150000 {
+		t.Errorf("wrong fork ID: %+v", node.ForkID)
+	}
+	if node.Head == nil || node.Head.Number != 900 || !node.Head.Verified || node.Head.BlocksBehind == nil || *node.Head.BlocksBehind != 100 {
+		t.Errorf("wrong head: %+v", node.Head)
+	}
+	if node.LastError == nil || node.LastError.Reason != 1 {
+		t.Errorf("wrong last error: %+v", node.LastError)
+	}
+	if len(node.History) != 2 || node.History[0].CrawlerID != "us" || node.History[1].CrawlerID != "eu" {
+		t.Errorf("wrong history: %+v", node.History)
+	}
+
+	if node, _ := getNode(t, srv, "/v1/nodes/c"); node == nil || node.Head == nil || node.Head.Number != 5000 || node.Head.Verified || node.Head.BlocksBehind != nil {
+		t.Errorf("wrong unverified head: %+v", node)
+	}
+	if node, _ := getNode(t, srv, "/v1/nodes/a?history=1"); node == nil || len(node.History) != 1 {
+		t.Errorf("history not limited: %+v", node)
+	}
+	if _, status := getNode(t, srv, "/v1/nodes/a?history=-1"); status != http.StatusBadRequest {
+		t.Errorf("invalid history limit: got status %d", status)
+	}
+	if _, status := getNode(t, srv, "/v1/nodes/d"); status != http.StatusNotFound {
+		t.Errorf("unknown node: got status %d", status)
+	}
+}
+
+// Nodes which the crawler carries over without probing them again are
+// reported with the same probe time and must not add to the history.
+func TestNodeHistory(t *testing.T) {
+	srv := newTestServer(t, []input.CrawledNode{
+		{ID: "a", CrawlerID: "eu", Now: 100, LastProbe: 90, Reachable: true},
+		{ID: "a", CrawlerID: "eu", Now: 200, LastProbe: 90, Reachable: true}, // carried over
+		{ID: "a", CrawlerID: "eu", Now: 300, LastProbe: 290},
+		// crawlers which don't send the probe time
+		{ID: "a", CrawlerID: "us", Now: 400, Reachable: true},
+		{ID: "a", CrawlerID: "us", Now: 500, Reachable: true},
+	})
+	node, _ := getNode(t, srv, "/v1/nodes/a")
+	if node == nil {
+		t.Fatal("node not found")
+	}
+	want := []struct {
+		time      int64
+		crawler   string
+		reachable bool
+	}{
+		{500, "us", true}, {400, "us", true}, {290, "eu", false}, {90, "eu", true},
+	}
+	if len(node.History) != len(want) {
+		t.Fatalf("got %d observations, want %d: %+v", len(node.History), len(want), node.History)
+	}
+	for i, o := range node.History {
+		if o.Timestamp.Unix() != want[i].time || o.CrawlerID != want[i].crawler || o.Reachable != want[i].reachable {
+			t.Errorf("observation %d: got %+v, want %+v", i, o, want[i])
+		}
+	}
+}
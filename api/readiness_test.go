@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/MariusVanDerWijden/node-crawler-backend/api"
+	"github.com/MariusVanDerWijden/node-crawler-backend/input"
+)
+
+func TestHandleReadiness(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	nodes := []input.CrawledNode{
+		{ID: "a", Now: 1, ClientType: "geth", ClientVersion: "v1.10.4", ForkHash: "0x0eb440f6", ForkNext: 12965000},
+		{ID: "b", Now: 1, ClientType: "geth", ClientVersion: "v1.10.2", ForkHash: "0x0eb440f6"},
+		{ID: "c", Now: 1, ClientType: "geth", ClientVersion: "v1.10.8", ForkHash: "0xb715077d"},
+		// no fork ID, judged by version
+		{ID: "d", Now: 1, ClientType: "go-opera", ClientVersion: "v1.1.0-rc.10"},
+		{ID: "e", Now: 1, ClientType: "go-opera", ClientVersion: "v1.1.0-rc.1"},
+		{ID: "f", Now: 1, ClientType: "go-opera"},
+	}
+	if err := InsertCrawledNodes(db, nodes); err != nil {
+		t.Fatal(err)
+	}
+	a := api.New(db)
+	err := a.SetReadiness(12965000, "0xd4e56740f876aef8c010b86a40d5f56745a118d0906a34e69aec8c0db1cb8fa3",
+		"1150000,1920000,2463000,2675000,4370000,7280000,9069000,9200000,12244000", "go-opera/1.1.0-rc.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/v1/readiness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	var res struct {
+		Ready, NotReady, Unknown int
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Ready != 3 || res.NotReady != 2 || res.Unknown != 1 {
+		t.Errorf("got %d ready, %d not ready, %d unknown, want 3, 2, 1", res.Ready, res.NotReady, res.Unknown)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// snapshotDimensions are the groupings of the dashboard which are recorded
+// in every snapshot, by the expression naming the group of a node.
+var snapshotDimensions = map[string]string{
+	"client":   "name",
+	"version":  "name || '/' || version_major || '.' || version_minor || '.' || version_patch",
+	"language": "language_name",
+	"os":       "os_name",
+	"country":  "country_name",
+}
+
+func snapshotDeamon(wg *sync.WaitGroup, db *sql.DB, interval time.Duration) {
+	defer wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		if err := takeSnapshot(db, time.Now()); err != nil {
+			fmt.Printf("Error taking snapshot: %v\n", err)
+		}
+	}
+}
+
+// takeSnapshot stores the current node counts of every dashboard grouping,
+// so their trend survives the nodes being dropped.
+func takeSnapshot(db *sql.DB, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO snapshots(timestamp) values(?)`, now.Unix()); err != nil {
+		return err
+	}
+	for dimension, expr := range snapshotDimensions {
+		query := fmt.Sprintf(`INSERT INTO snapshot_counts(timestamp, dimension, name, nodes, reachable)
+			SELECT ?, ?, IFNULL(%v, ''), COUNT(*), IFNULL(SUM(reachable), 0) FROM nodes GROUP BY 3`, expr)
+		if _, err := tx.Exec(query, now.Unix(), dimension); err != nil {
+			return err
+		}
+	}
+	fmt.Println("Took snapshot of the node counts")
+	return tx.Commit()
+}
+
+// dropOldSnapshots deletes the snapshots older than the retention period.
+func dropOldSnapshots(db *sql.DB, retention time.Duration) error {
+	oldest := time.Now().Add(-retention).Unix()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM snapshot_counts WHERE timestamp < ?`, oldest); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`DELETE FROM snapshots WHERE timestamp < ?`, oldest)
+	if err != nil {
+		return err
+	}
+	affected, _ := res.RowsAffected()
+	fmt.Printf("Dropped %v snapshots\n", affected)
+	return tx.Commit()
+}
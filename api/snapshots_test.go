@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MariusVanDerWijden/node-crawler-backend/input"
+)
+
+func TestTakeSnapshot(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	nodes := []input.CrawledNode{
+		{ID: "a", ClientType: "go-opera", ClientVersion: "v1.1.0-rc.4", Now: 1, Reachable: true},
+		{ID: "b", ClientType: "go-opera", ClientVersion: "v1.0.2", Now: 1},
+		{ID: "c", ClientType: "go-opera", ClientVersion: "v1.1.0-rc.4", Now: 1, Reachable: true},
+	}
+	if err := InsertCrawledNodes(db, nodes); err != nil {
+		t.Fatal(err)
+	}
+	if err := takeSnapshot(db, time.Unix(100, 0)); err != nil {
+		t.Fatal(err)
+	}
+	var count, reachable int
+	err := db.QueryRow(`SELECT nodes, reachable FROM snapshot_counts WHERE timestamp = 100 AND dimension = 'version' AND name = 'go-opera/1.1.0'`).Scan(&count, &reachable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || reachable != 2 {
+		t.Fatalf("wrong counts: got %d nodes, %d reachable, want 2, 2", count, reachable)
+	}
+}
+
+func TestDropOldSnapshots(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertCrawledNodes(db, []input.CrawledNode{{ID: "a", ClientType: "go-opera", Now: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, age := range []time.Duration{48 * time.Hour, 25 * time.Hour, time.Hour} {
+		if err := takeSnapshot(db, now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dropOldSnapshots(db, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	var snapshots, counts int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM snapshots`).Scan(&snapshots); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT COUNT(DISTINCT timestamp) FROM snapshot_counts`).Scan(&counts); err != nil {
+		t.Fatal(err)
+	}
+	if snapshots != 1 || counts != 1 {
+		t.Fatalf("got %d snapshots with counts at %d times, want 1", snapshots, counts)
+	}
+}
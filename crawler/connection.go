@@ -20,6 +20,7 @@ import (
 	"crypto/ecdsa"
 	"fmt"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/eth/protocols/eth"
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/p2p/rlpx"
@@ -95,6 +96,17 @@ type BlockHeaders eth.BlockHeadersPacket
 
 func (bh BlockHeaders) Code() int { return 20 }
 
+// GetBlockHeaders66 is a block header query over eth/66, which tags every
+// request with an ID.
+type GetBlockHeaders66 eth.GetBlockHeadersPacket66
+
+func (g GetBlockHeaders66) Code() int { return 19 }
+
+// BlockHeaders66 is the response to GetBlockHeaders66.
+type BlockHeaders66 eth.BlockHeadersPacket66
+
+func (bh BlockHeaders66) Code() int { return 20 }
+
 // GetBlockBodies represents a GetBlockBodies request
 type GetBlockBodies eth.GetBlockBodiesPacket
 
@@ -115,6 +127,17 @@ type NewPooledTransactionHashes eth.NewPooledTransactionHashesPacket
 
 func (nb NewPooledTransactionHashes) Code() int { return 24 }
 
+// NewPooledTransactionHashes68 is the tx hash propagation message of eth/68,
+// which announces the types and sizes of the transactions along with their
+// hashes.
+type NewPooledTransactionHashes68 struct {
+	Types  []byte
+	Sizes  []uint32
+	Hashes []common.Hash
+}
+
+func (nb NewPooledTransactionHashes68) Code() int { return 24 }
+
 type GetPooledTransactions eth.GetPooledTransactionsPacket
 
 func (gpt GetPooledTransactions) Code() int { return 25 }
@@ -123,19 +146,72 @@ type PooledTransactions eth.PooledTransactionsPacket
 
 func (pt PooledTransactions) Code() int { return 26 }
 
+const (
+	// baseProtocolLength is the number of message codes reserved for the
+	// devp2p base protocol. Sub-protocol codes start at this offset.
+	baseProtocolLength = 16
+	// ethProtocolLength is the number of message codes used by eth/64-68.
+	// eth/67 dropped GetNodeData and NodeData but kept their codes reserved.
+	ethProtocolLength = 17
+
+	operaProtocolName = "opera"
+)
+
+// operaMessage is implemented by the messages of the go-opera "opera"
+// sub-protocol. Their codes are relative to the offset negotiated for the
+// protocol in the Hello exchange.
+type operaMessage interface {
+	Message
+	operaMessage()
+}
+
+// OperaHandshake is the first message exchanged on the opera protocol.
+type OperaHandshake struct {
+	ProtocolVersion uint32
+	NetworkID       uint64
+	Genesis         common.Hash
+
+	// Ignore additional fields (for forward compatibility).
+	Rest []rlp.RawValue `rlp:"tail"`
+}
+
+func (h OperaHandshake) Code() int     { return 0 }
+func (h OperaHandshake) operaMessage() {}
+
+// OperaProgress is the synchronization status an opera peer sends right
+// after the handshake.
+type OperaProgress struct {
+	Epoch            uint32
+	LastBlockIdx     uint64
+	LastBlockAtropos common.Hash
+	HighestLamport   uint32
+
+	// Ignore additional fields (for forward compatibility).
+	Rest []rlp.RawValue `rlp:"tail"`
+}
+
+func (p OperaProgress) Code() int     { return 1 }
+func (p OperaProgress) operaMessage() {}
+
 // Conn represents an individual connection with a peer
 type Conn struct {
 	*rlpx.Conn
 	ourKey                 *ecdsa.PrivateKey
 	negotiatedProtoVersion uint
 	ourHighestProtoVersion uint
+	operaProtoVersion      uint
+	ourHighestOperaVersion uint
+	operaOffset            uint64
 	caps                   []p2p.Cap
 }
 
 func (c *Conn) Read() Message {
 	code, rawData, _, err := c.Conn.Read()
 	if err != nil {
-		return errorf("could not read from connection: %v", err)
+		return errorf("could not read from connection: %w", err)
+	}
+	if c.operaProtoVersion > 0 && code >= c.operaOffset {
+		return c.readOperaMessage(code-c.operaOffset, rawData)
 	}
 
 	var msg Message
@@ -151,9 +227,17 @@ func (c *Conn) Read() Message {
 	case (Status{}).Code():
 		msg = new(Status)
 	case (GetBlockHeaders{}).Code():
-		msg = new(GetBlockHeaders)
+		if c.negotiatedProtoVersion >= 66 {
+			msg = new(GetBlockHeaders66)
+		} else {
+			msg = new(GetBlockHeaders)
+		}
 	case (BlockHeaders{}).Code():
-		msg = new(BlockHeaders)
+		if c.negotiatedProtoVersion >= 66 {
+			msg = new(BlockHeaders66)
+		} else {
+			msg = new(BlockHeaders)
+		}
 	case (GetBlockBodies{}).Code():
 		msg = new(GetBlockBodies)
 	case (BlockBodies{}).Code():
@@ -165,7 +249,11 @@ func (c *Conn) Read() Message {
 	case (Transactions{}).Code():
 		msg = new(Transactions)
 	case (NewPooledTransactionHashes{}).Code():
-		msg = new(NewPooledTransactionHashes)
+		if c.negotiatedProtoVersion >= 68 {
+			msg = new(NewPooledTransactionHashes68)
+		} else {
+			msg = new(NewPooledTransactionHashes)
+		}
 	case (GetPooledTransactions{}.Code()):
 		msg = new(GetPooledTransactions)
 	case (PooledTransactions{}.Code()):
@@ -175,13 +263,30 @@ func (c *Conn) Read() Message {
 	}
 	// if message is devp2p, decode here
 	if err := rlp.DecodeBytes(rawData, msg); err != nil {
-		return errorf("could not rlp decode message: %v", err)
+		return errorf("%w: %v", errDecode, err)
+	}
+	return msg
+}
+
+// readOperaMessage decodes a message of the opera protocol. The code must
+// already be relative to the negotiated opera offset.
+func (c *Conn) readOperaMessage(code uint64, rawData []byte) Message {
+	var msg Message
+	switch int(code) {
+	case (OperaHandshake{}).Code():
+		msg = new(OperaHandshake)
+	case (OperaProgress{}).Code():
+		msg = new(OperaProgress)
+	default:
+		return errorf("invalid opera message code: %d", code)
+	}
+	if err := rlp.DecodeBytes(rawData, msg); err != nil {
+		return errorf("%w: %v", errDecode, err)
 	}
 	return msg
 }
 
 func (c *Conn) Write(msg Message) error {
-	// check if message is eth protocol message
 	var (
 		payload []byte
 		err     error
@@ -190,7 +295,12 @@ func (c *Conn) Write(msg Message) error {
 	if err != nil {
 		return err
 	}
-	_, err = c.Conn.Write(uint64(msg.Code()), payload)
+	code := uint64(msg.Code())
+	// opera protocol messages are shifted by the negotiated offset
+	if _, ok := msg.(operaMessage); ok {
+		code += c.operaOffset
+	}
+	_, err = c.Conn.Write(code, payload)
 	return err
 }
 
@@ -208,3 +318,23 @@ func (c *Conn) negotiateEthProtocol(caps []p2p.Cap) {
 	}
 	c.negotiatedProtoVersion = highestEthVersion
 }
+
+// negotiateOperaProtocol sets the Conn's opera protocol version to the
+// highest version shared with the peer. Matched protocols are laid out in
+// alphabetical order, so the opera messages follow those of eth.
+func (c *Conn) negotiateOperaProtocol(caps []p2p.Cap) {
+	var highestOperaVersion uint
+	for _, capability := range caps {
+		if capability.Name != operaProtocolName {
+			continue
+		}
+		if capability.Version > highestOperaVersion && capability.Version <= c.ourHighestOperaVersion {
+			highestOperaVersion = capability.Version
+		}
+	}
+	c.operaProtoVersion = highestOperaVersion
+	c.operaOffset = baseProtocolLength
+	if c.negotiatedProtoVersion > 0 {
+		c.operaOffset += ethProtocolLength
+	}
+}
@@ -17,12 +17,9 @@
 package main
 
 import (
-	"fmt"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 )
@@ -30,9 +27,8 @@ import (
 type crawler struct {
 	output nodeSet
 
-	genesis   *core.Genesis
-	networkID uint64
-	nodeURL   string
+	network *network
+	nodeURL string
 
 	disc resolver
 
@@ -41,40 +37,74 @@ type crawler struct {
 
 	ch     chan *enode.Node
 	closed chan struct{}
+	// abort is closed when the shutdown grace period expires, the
+	// workers then skip the remaining queued probes.
+	abort chan struct{}
 
 	// settings
 	revalidateInterval time.Duration
+	probeInterval      time.Duration
+	schedule           probeSchedule
+	timeouts           probeTimeouts
+	shutdownGrace      time.Duration
 
 	reqCh   chan *enode.Node
 	workers int
-
-
-	// errors
-	tooManyPeersError  uint64
+	// backlog holds nodes which didn't fit into reqCh, up to backlogSize.
+	// It is only accessed by the run loop.
+	backlog     []*enode.Node
+	backlogSize int
 
 	sync.WaitGroup
 	sync.RWMutex
 }
 
 
+// crawlerConfig holds the tunables of the node prober.
+type crawlerConfig struct {
+	Workers     int
+	QueueSize   int
+	BacklogSize int
+	// RevalidateInterval is the minimum time between two discovery
+	// liveness checks of a node, ProbeInterval between two RLPx probes.
+	RevalidateInterval time.Duration
+	ProbeInterval      time.Duration
+	// Schedule holds the next probe times persisted by a previous run,
+	// for nodes which don't carry one.
+	Schedule probeSchedule
+	Timeouts probeTimeouts
+	// ShutdownGrace is how long queued probes may run after stop.
+	ShutdownGrace time.Duration
+}
+
+// probeSchedule maps nodes to the earliest time of their next RLPx probe.
+type probeSchedule map[enode.ID]time.Time
+
 type resolver interface {
 	RequestENR(*enode.Node) (*enode.Node, error)
 	RandomNodes() enode.Iterator
+	Ping(*enode.Node) error
 }
 
-func newCrawler(genesis *core.Genesis, networkID uint64, nodeURL string, input nodeSet, disc resolver, iters ...enode.Iterator) *crawler {
+func newCrawler(net *network, nodeURL string, cfg crawlerConfig, input nodeSet, disc resolver, iters ...enode.Iterator) *crawler {
 	c := &crawler{
-		output:    make(nodeSet, len(input)),
-		genesis:   genesis,
-		networkID: networkID,
-		nodeURL:   nodeURL,
-		disc:      disc,
-		iters:     iters,
-		inputIter: enode.IterNodes(input.nodes()),
-		ch:        make(chan *enode.Node),
-		reqCh:     make(chan *enode.Node, 1024), // TODO: define this in config
-		workers:   32,                          // TODO: define this in config
-		closed:    make(chan struct{}),
+		output:             make(nodeSet, len(input)),
+		network:            net,
+		nodeURL:            nodeURL,
+		disc:               disc,
+		iters:              iters,
+		inputIter:          enode.IterNodes(input.nodes()),
+		ch:                 make(chan *enode.Node),
+		reqCh:              make(chan *enode.Node, cfg.QueueSize),
+		workers:            cfg.Workers,
+		backlogSize:        cfg.BacklogSize,
+		revalidateInterval: cfg.RevalidateInterval,
+		probeInterval:      cfg.ProbeInterval,
+		schedule:           cfg.Schedule,
+		timeouts:           cfg.Timeouts,
+		closed:             make(chan struct{}),
+		abort:              make(chan struct{}),
+		shutdownGrace:      cfg.ShutdownGrace,
 	}
 	c.iters = append(c.iters, c.inputIter)
 	// Copy input to output initially. Any nodes that fail validation
@@ -85,13 +115,18 @@ func newCrawler(genesis *core.Genesis, networkID uint64, nodeURL string, input n
 	return c
 }
 
-func (c *crawler) run(timeout time.Duration) nodeSet {
+// run crawls until the timeout expires after the input set was revalidated,
+// all iterators are exhausted or stop is closed. On stop, the queued probes
+// and the backlog may finish within the shutdown grace period. Probes which
+// haven't started by then are dropped and retried in the next run.
+func (c *crawler) run(timeout time.Duration, stop <-chan struct{}) nodeSet {
 	var (
 		timeoutTimer = time.NewTimer(timeout)
 		timeoutCh    <-chan time.Time
 		doneCh       = make(chan enode.Iterator, len(c.iters))
 		liveIters    = len(c.iters)
 		inputSetLen  = len(c.output)
+		stopped      bool
 	)
 	defer timeoutTimer.Stop()
 
@@ -99,6 +134,8 @@ func (c *crawler) run(timeout time.Duration) nodeSet {
 		go c.runIterator(doneCh, it)
 	}
 
+	workersGauge.Inc(int64(c.workers))
+	defer workersGauge.Dec(int64(c.workers))
 	for i := 0; i < c.workers; i++ {
 		c.Add(1)
 		go c.getClientInfoLoop()
@@ -106,9 +143,20 @@ func (c *crawler) run(timeout time.Duration) nodeSet {
 
 loop:
 	for {
+		// Feed the backlog to the workers whenever the queue has room.
+		var (
+			backlogCh   chan *enode.Node
+			backlogNext *enode.Node
+		)
+		if len(c.backlog) > 0 {
+			backlogCh, backlogNext = c.reqCh, c.backlog[0]
+		}
 		select {
 		case n := <-c.ch:
 			c.updateNode(n)
+		case backlogCh <- backlogNext:
+			c.backlog[0] = nil
+			c.backlog = c.backlog[1:]
 		case it := <-doneCh:
 			if it == c.inputIter {
 				// Enable timeout when we're done revalidating the input nodes.
@@ -122,10 +170,29 @@ loop:
 			}
 		case <-timeoutCh:
 			break loop
+		case <-stop:
+			stopped = true
+			break loop
 		}
 	}
 
 	close(c.closed)
+	var grace *time.Timer
+	if stopped {
+		log.Info("Finishing queued probes", "queued", len(c.reqCh), "backlog", len(c.backlog), "grace", c.shutdownGrace)
+		grace = time.NewTimer(c.shutdownGrace)
+		defer grace.Stop()
+		if !c.flushBacklog(grace.C) {
+			close(c.abort)
+		}
+	}
+	if len(c.backlog) > 0 {
+		log.Info("Probe backlog not drained", "len", len(c.backlog))
+		queueDepthGauge.Dec(int64(len(c.backlog)))
+		for _, n := range c.backlog {
+			c.unschedule(n)
+		}
+	}
 	close(c.reqCh)
 	for _, it := range c.iters {
 		it.Close()
@@ -133,6 +200,9 @@ loop:
 	for ; liveIters > 0; liveIters-- {
 		<-doneCh
 	}
+	if stopped {
+		c.waitWorkers(grace.C)
+	}
 	c.Wait()
 
 	close(c.ch)
@@ -140,6 +210,38 @@ loop:
 	return c.output
 }
 
+// flushBacklog hands the backlog to the workers. It returns false if the
+// grace period expired before.
+func (c *crawler) flushBacklog(grace <-chan time.Time) bool {
+	for len(c.backlog) > 0 {
+		select {
+		case c.reqCh <- c.backlog[0]:
+			c.backlog[0] = nil
+			c.backlog = c.backlog[1:]
+		case <-grace:
+			return false
+		}
+	}
+	return true
+}
+
+// waitWorkers waits until the workers finished the queue. If the grace
+// period expires first, the remaining queued probes are skipped.
+func (c *crawler) waitWorkers(grace <-chan time.Time) {
+	done := make(chan struct{})
+	go func() {
+		c.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-c.abort:
+	case <-grace:
+		log.Info("Shutdown grace period expired, dropping queued probes", "len", len(c.reqCh))
+		close(c.abort)
+	}
+}
+
 func (c *crawler) runIterator(done chan<- enode.Iterator, it enode.Iterator) {
 	defer func() { done <- it }()
 	for it.Next() {
@@ -159,28 +261,42 @@ func (c *crawler) getClientInfoLoop() {
 			if !ok {
 				return
 			}
+			queueDepthGauge.Dec(1)
+			select {
+			case <-c.abort:
+				c.unschedule(n)
+				continue
+			default:
+			}
+			busyWorkersGauge.Inc(1)
 
-			errorReason := 0
 			errorString := ""
-			var scoreInc int
+			var (
+				scoreInc int
+				timings  probeTimings
+			)
+
+			// Ping the node over discovery while it is probed.
+			pingc := make(chan time.Duration, 1)
+			go func() {
+				start := time.Now()
+				if err := c.disc.Ping(n); err != nil {
+					pingc <- 0
+					return
+				}
+				pingc <- time.Since(start)
+			}()
 
-			info, err := getClientInfo(c.genesis, c.networkID, c.nodeURL, n)
+			info, err := getClientInfo(c.network, c.nodeURL, c.timeouts, n, &timings)
+			timings.Ping = <-pingc
+			errorCode := probeErrorCodeOf(err)
 			if err != nil {
-				errStrings := strings.Split(err.Error(), ":")
-				if len(errStrings) >=2 {
-					lastError := errStrings[len(errStrings)-1]
-					if strings.Contains(lastError, "decoding into (main.Status).NetworkID") {
-						lastError = " error decoding NetworkID"
-					}
-					clientType := fmt.Sprintf(errStrings[0] +  lastError)
-					clientType = strings.Replace(clientType, " ",  "_",10)
-					info.ClientType = clientType
-				}
-				errorReason = -1
 				errorString = err.Error()
-				log.Warn("GetClientInfo failed", "error", err, "nodeID", n.ID())
+				log.Warn("GetClientInfo failed", "error", err, "class", errorCode, "nodeID", n.ID())
+				markDialFailure(errorCode)
 			} else {
 				scoreInc = 10
+				dialSuccessCounter.Inc(1)
 			}
 
 			if info != nil {
@@ -194,7 +310,10 @@ func (c *crawler) getClientInfoLoop() {
 					"version", info.SoftwareVersion,
 					"network_id", info.NetworkID,
 					"caps", info.Capabilities,
+					"eth", info.EthVersion,
+					"opera", info.OperaVersion,
 					"fork_id", info.ForkID,
+					"epoch", info.Epoch,
 					"height", info.Blockheight,
 					"td", info.TotalDifficulty,
 					"head", info.HeadHash,
@@ -209,30 +328,44 @@ func (c *crawler) getClientInfoLoop() {
 			if info != nil {
 				node.Info = info
 			}
-			node.ErrorReason = errorReason
+			node.ErrorReason = int(errorCode)
 			node.ErrorString = errorString
+			node.DisconnectReason = disconnectReasonOf(err)
 			node.Score += scoreInc
+			node.Reachable = err == nil
+			node.Latency = timings.probe()
+			node.Timings = timings
+			node.LastProbe = time.Now().UTC().Truncate(time.Second)
 			c.output[n.ID()] = node
 			c.Unlock()
+			busyWorkersGauge.Dec(1)
 		}
 	}
 }
 
+// updateNode revalidates a node found by discovery and queues it for probing
+// if its next probe is due. It runs on the discovery loop, so it must never
+// block on the workers.
 func (c *crawler) updateNode(n *enode.Node) {
-	c.Lock()
-	defer c.Unlock()
-
+	c.RLock()
 	node, ok := c.output[n.ID()]
+	c.RUnlock()
 
 	// Skip validation of recently-seen nodes.
 	if ok && time.Since(node.LastCheck) < c.revalidateInterval {
 		return
 	}
 
-	node.LastCheck = time.Now().UTC().Truncate(time.Second)
-
-	// Request the node record.
+	// Request the node record without holding the lock, the workers
+	// need it to store their results.
+	now := time.Now().UTC().Truncate(time.Second)
 	nn, err := c.disc.RequestENR(n)
+
+	c.Lock()
+	defer c.Unlock()
+
+	node = c.output[n.ID()]
+	node.LastCheck = now
 	if err != nil {
 		if node.Score == 0 {
 			// Node doesn't implement EIP-868.
@@ -256,8 +389,48 @@ func (c *crawler) updateNode(n *enode.Node) {
 		delete(c.output, n.ID())
 	} else {
 		log.Info("Updating node", "id", n.ID(), "seq", n.Seq(), "score", node.Score)
-		c.reqCh <- n
+		if node.NextProbe.IsZero() {
+			node.NextProbe = c.schedule[n.ID()]
+		}
+		// The next probe is scheduled when the node is queued, so it
+		// isn't queued twice if discovery finds it again meanwhile.
+		if !now.Before(node.NextProbe) && c.enqueue(n) {
+			node.NextProbe = now.Add(c.probeInterval)
+		}
 		c.output[n.ID()] = node
 	}
 }
 
+// unschedule makes a node which was queued but not probed due again. The
+// probe is due now rather than unset, which would fall back to the schedule
+// loaded at startup.
+func (c *crawler) unschedule(n *enode.Node) {
+	c.Lock()
+	defer c.Unlock()
+	if node, ok := c.output[n.ID()]; ok {
+		node.NextProbe = time.Now().UTC().Truncate(time.Second)
+		c.output[n.ID()] = node
+	}
+}
+
+// enqueue hands a node to the probe workers. If the queue is full, the node
+// is spilled to the backlog which the run loop drains as workers free up. If
+// the backlog is full too, the node is left for the next round and enqueue
+// returns false.
+func (c *crawler) enqueue(n *enode.Node) bool {
+	if len(c.backlog) == 0 {
+		select {
+		case c.reqCh <- n:
+			queueDepthGauge.Inc(1)
+			return true
+		default:
+		}
+	}
+	if len(c.backlog) >= c.backlogSize {
+		log.Debug("Probe backlog full, deferring node", "id", n.ID(), "backlog", len(c.backlog))
+		return false
+	}
+	queueDepthGauge.Inc(1)
+	c.backlog = append(c.backlog, n)
+	return true
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// testResolver answers every discovery request.
+type testResolver struct{}
+
+func (testResolver) RequestENR(n *enode.Node) (*enode.Node, error) { return n, nil }
+func (testResolver) RandomNodes() enode.Iterator                   { return enode.IterNodes(nil) }
+func (testResolver) Ping(*enode.Node) error                        { return nil }
+
+func newTestNode(t *testing.T) *enode.Node {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enode.NewV4(&key.PublicKey, []byte{127, 0, 0, 1}, 30303, 30303)
+}
+
+func TestCheckCrawlFlags(t *testing.T) {
+	flags := []cli.Flag{workersFlag, queueSizeFlag, backlogSizeFlag, strategyFlag, exhaustiveWorkersFlag, topologyWorkersFlag, topologyBucketsFlag}
+	tests := []struct {
+		args    []string
+		wantErr bool
+	}{
+		{args: nil},
+		{args: []string{"--workers", "1", "--queue", "0", "--queue.backlog", "0"}},
+		{args: []string{"--strategy", "exhaustive"}},
+		{args: []string{"--strategy", "exhaustive", "--exhaustive.workers", "1"}},
+		{args: []string{"--exhaustive.workers", "0"}, wantErr: true},
+		{args: []string{"--exhaustive.workers", "-1"}, wantErr: true},
+		{args: []string{"--workers", "0"}, wantErr: true},
+		{args: []string{"--workers", "-1"}, wantErr: true},
+		{args: []string{"--queue", "-1"}, wantErr: true},
+		{args: []string{"--queue.backlog", "-1"}, wantErr: true},
+		{args: []string{"--strategy", "bfs"}, wantErr: true},
+		{args: []string{"--topology.workers", "1", "--topology.buckets", "1"}},
+		{args: []string{"--topology.workers", "0"}, wantErr: true},
+		{args: []string{"--topology.buckets", "0"}, wantErr: true},
+		{args: []string{"--topology.buckets", "-1"}, wantErr: true},
+	}
+	for _, test := range tests {
+		err := checkCrawlFlags(newTestContext(t, flags, test.args...))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: got error %v, want error %v", test.args, err, test.wantErr)
+		}
+	}
+}
+
+func TestEnqueueBacklogLimit(t *testing.T) {
+	cfg := crawlerConfig{Workers: 1, QueueSize: 2, BacklogSize: 3, ProbeInterval: time.Hour}
+	c := newCrawler(&network{}, "", cfg, nil, testResolver{})
+
+	var accepted int
+	for i := 0; i < 10; i++ {
+		if c.enqueue(newTestNode(t)) {
+			accepted++
+		}
+	}
+	if accepted != 5 {
+		t.Errorf("accepted %d nodes, want queue and backlog size 5", accepted)
+	}
+	if len(c.reqCh) != 2 || len(c.backlog) != 3 {
+		t.Errorf("queue %d backlog %d, want 2 and 3", len(c.reqCh), len(c.backlog))
+	}
+}
+
+func TestUpdateNodeDefersWhenBacklogFull(t *testing.T) {
+	cfg := crawlerConfig{Workers: 1, QueueSize: 0, BacklogSize: 0, ProbeInterval: time.Hour}
+	c := newCrawler(&network{}, "", cfg, nil, testResolver{})
+
+	n := newTestNode(t)
+	c.updateNode(n)
+	node, ok := c.output[n.ID()]
+	if !ok {
+		t.Fatal("node not stored")
+	}
+	if !node.NextProbe.IsZero() {
+		t.Errorf("node which wasn't queued is scheduled for %v", node.NextProbe)
+	}
+}
+
+// runStopped queues the given number of probes against a closed port and
+// runs the crawler with stop already closed.
+func runStopped(t *testing.T, probes int, grace time.Duration) (nodeSet, []*enode.Node) {
+	t.Helper()
+	cfg := crawlerConfig{
+		Workers:       2,
+		QueueSize:     2,
+		BacklogSize:   probes,
+		ProbeInterval: time.Hour,
+		Timeouts:      probeTimeouts{Dial: time.Second, Hello: time.Second, Status: time.Second},
+		ShutdownGrace: grace,
+	}
+	c := newCrawler(&network{}, "", cfg, nil, testResolver{})
+	var nodes []*enode.Node
+	for i := 0; i < probes; i++ {
+		key, _ := crypto.GenerateKey()
+		n := enode.NewV4(&key.PublicKey, []byte{127, 0, 0, 1}, 1, 0)
+		c.output[n.ID()] = nodeJSON{N: n, Score: 1, NextProbe: time.Now().Add(time.Hour)}
+		if !c.enqueue(n) {
+			t.Fatal("probe not queued")
+		}
+		nodes = append(nodes, n)
+	}
+	stop := make(chan struct{})
+	close(stop)
+	return c.run(time.Minute, stop), nodes
+}
+
+func TestStopFinishesQueue(t *testing.T) {
+	output, nodes := runStopped(t, 10, time.Minute)
+	for _, n := range nodes {
+		if output[n.ID()].LastProbe.IsZero() {
+			t.Errorf("queued node %v not probed before shutdown", n.ID())
+		}
+	}
+}
+
+func TestStopDropsQueueAfterGrace(t *testing.T) {
+	output, nodes := runStopped(t, 10, 0)
+	var dropped int
+	for _, n := range nodes {
+		node := output[n.ID()]
+		if node.LastProbe.IsZero() {
+			dropped++
+			if node.NextProbe.After(time.Now()) {
+				t.Errorf("dropped node %v still scheduled for %v", n.ID(), node.NextProbe)
+			}
+		}
+	}
+	if dropped == 0 {
+		t.Error("no probes dropped without grace period")
+	}
+}
+
+func TestUnscheduledNodeIgnoresStartupSchedule(t *testing.T) {
+	n := newTestNode(t)
+	cfg := crawlerConfig{
+		Workers:       1,
+		QueueSize:     1,
+		ProbeInterval: time.Hour,
+		Schedule:      probeSchedule{n.ID(): time.Now().Add(time.Hour)},
+	}
+	c := newCrawler(&network{}, "", cfg, nil, testResolver{})
+	c.output[n.ID()] = nodeJSON{N: n, Score: 1, NextProbe: time.Now().Add(time.Hour)}
+
+	// The node was queued, but the probe was dropped.
+	c.unschedule(n)
+	c.updateNode(n)
+	if len(c.reqCh) != 1 {
+		t.Fatal("unscheduled node not queued again")
+	}
+	if next := c.output[n.ID()].NextProbe; next.Before(time.Now().Add(time.Hour - time.Minute)) {
+		t.Errorf("queued node scheduled for %v", next)
+	}
+}
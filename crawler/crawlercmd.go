@@ -18,17 +18,18 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 
 	"github.com/oschwald/geoip2-golang"
 
-	"github.com/ethereum/go-ethereum/cmd/utils"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p/discover"
 	"github.com/ethereum/go-ethereum/p2p/enode"
@@ -43,22 +44,54 @@ var (
 		ArgsUsage: "<nodefile>",
 		Action:    crawlNodes,
 		Flags: []cli.Flag{
-			utils.MainnetFlag,
-			utils.RopstenFlag,
-			utils.RinkebyFlag,
-			utils.GoerliFlag,
-			utils.NetworkIdFlag,
+			networkFlag,
+			networkFileFlag,
+			networkIDFlag,
 			bootnodesFlag,
 			nodeURLFlag,
 			nodeFileFlag,
 			timeoutFlag,
+			roundsFlag,
+			shutdownGraceFlag,
 			tableNameFlag,
+			historyRetentionFlag,
+			instanceFlag,
+			apiURLFlag,
+			apiTokenFlag,
 			listenAddrFlag,
 			nodekeyFlag,
 			nodedbFlag,
 			geoipdbFlag,
+			workersFlag,
+			queueSizeFlag,
+			backlogSizeFlag,
+			revalidateIntervalFlag,
+			probeIntervalFlag,
+			dialTimeoutFlag,
+			helloTimeoutFlag,
+			statusTimeoutFlag,
+			strategyFlag,
+			exhaustiveWorkersFlag,
+			exhaustiveTimeoutFlag,
+			topologyFlag,
+			topologyBucketsFlag,
+			topologyWorkersFlag,
+			topologyTimeoutFlag,
 		},
 	}
+	networkFlag = cli.StringFlag{
+		Name:  "network",
+		Usage: "Network preset to crawl (mainnet, testnet, custom)",
+		Value: "mainnet",
+	}
+	networkFileFlag = cli.StringFlag{
+		Name:  "network.file",
+		Usage: "Path to a JSON network definition for the custom network",
+	}
+	networkIDFlag = cli.Uint64Flag{
+		Name:  "networkid",
+		Usage: "Override the network ID of the network preset",
+	}
 	bootnodesFlag = cli.StringFlag{
 		Name:  "bootnodes",
 		Usage: "Comma separated nodes used for bootstrapping",
@@ -77,10 +110,36 @@ var (
 		Usage: "Timeout for the crawling in a round",
 		Value: 5 * time.Minute,
 	}
+	roundsFlag = cli.IntFlag{
+		Name:  "rounds",
+		Usage: "Number of crawl rounds to run before exiting (0 = run forever)",
+	}
+	shutdownGraceFlag = cli.DurationFlag{
+		Name:  "shutdown.grace",
+		Usage: "How long queued probes may run after SIGINT or SIGTERM before they are dropped",
+		Value: 30 * time.Second,
+	}
 	tableNameFlag = cli.StringFlag{
 		Name:  "table",
 		Usage: "Name of the sqlite table",
 	}
+	historyRetentionFlag = cli.DurationFlag{
+		Name:  "history.retention",
+		Usage: "How long to keep per-round node observations (0 = forever)",
+		Value: 30 * 24 * time.Hour,
+	}
+	instanceFlag = cli.StringFlag{
+		Name:  "instance",
+		Usage: "ID of this crawler instance, used to merge the results of several crawlers (default: hostname)",
+	}
+	apiURLFlag = cli.StringFlag{
+		Name:  "api.url",
+		Usage: "Base URL of an API to push crawl results to (e.g. http://localhost:4000)",
+	}
+	apiTokenFlag = cli.StringFlag{
+		Name:  "api.token",
+		Usage: "Bearer token for the ingestion endpoint of the API",
+	}
 	listenAddrFlag = cli.StringFlag{
 		Name:  "addr",
 		Usage: "Listening address",
@@ -97,12 +156,96 @@ var (
 		Name:  "geoipdb",
 		Usage: "geoip2 database location",
 	}
+	workersFlag = cli.IntFlag{
+		Name:  "workers",
+		Usage: "Number of concurrent node probes",
+		Value: 32,
+	}
+	queueSizeFlag = cli.IntFlag{
+		Name:  "queue",
+		Usage: "Capacity of the probe queue, overflow is kept in a backlog",
+		Value: 1024,
+	}
+	backlogSizeFlag = cli.IntFlag{
+		Name:  "queue.backlog",
+		Usage: "Maximum number of probes kept in the backlog, further nodes are probed in the next round",
+		Value: 65536,
+	}
+	revalidateIntervalFlag = cli.DurationFlag{
+		Name:  "revalidate.interval",
+		Usage: "Minimum time between two discovery liveness checks (ENR requests) of a node",
+		Value: 10 * time.Minute,
+	}
+	probeIntervalFlag = cli.DurationFlag{
+		Name:  "probe.interval",
+		Usage: "Minimum time between two RLPx probes of a node",
+		Value: time.Hour,
+	}
+	dialTimeoutFlag = cli.DurationFlag{
+		Name:  "dial.timeout",
+		Usage: "Timeout for the TCP connection and RLPx handshake",
+		Value: 15 * time.Second,
+	}
+	helloTimeoutFlag = cli.DurationFlag{
+		Name:  "hello.timeout",
+		Usage: "Timeout for the Hello exchange",
+		Value: 5 * time.Second,
+	}
+	statusTimeoutFlag = cli.DurationFlag{
+		Name:  "status.timeout",
+		Usage: "Timeout for the opera handshake or eth Status exchange",
+		Value: 15 * time.Second,
+	}
+	strategyFlag = cli.StringFlag{
+		Name:  "strategy",
+		Usage: "How nodes are discovered: random (random lookups until --timeout) or exhaustive (enumerate the routing tables of all nodes found)",
+		Value: "random",
+	}
+	exhaustiveWorkersFlag = cli.IntFlag{
+		Name:  "exhaustive.workers",
+		Usage: "Number of routing tables enumerated concurrently by the exhaustive strategy",
+		Value: 32,
+	}
+	exhaustiveTimeoutFlag = cli.DurationFlag{
+		Name:  "exhaustive.timeout",
+		Usage: "Timeout for FINDNODE responses of the exhaustive strategy",
+		Value: 500 * time.Millisecond,
+	}
+	topologyFlag = cli.BoolFlag{
+		Name:  "topology",
+		Usage: "Record the routing tables of responsive nodes after every round (requires --table)",
+	}
+	topologyBucketsFlag = cli.IntFlag{
+		Name:  "topology.buckets",
+		Usage: "Number of log-distances queried per node, counting down from 256",
+		Value: 17,
+	}
+	topologyWorkersFlag = cli.IntFlag{
+		Name:  "topology.workers",
+		Usage: "Number of nodes queried concurrently for the topology",
+		Value: 16,
+	}
+	topologyTimeoutFlag = cli.DurationFlag{
+		Name:  "topology.timeout",
+		Usage: "Timeout for FINDNODE responses",
+		Value: 500 * time.Millisecond,
+	}
 )
 
 func crawlNodes(ctx *cli.Context) error {
 	var inputSet nodeSet
 	var geoipDB *geoip2.Reader
 
+	net, err := makeNetwork(ctx)
+	if err != nil {
+		return err
+	}
+	log.Info("Crawling network", "name", net.Name, "id", net.NetworkID, "genesis", net.Genesis)
+
+	if err := checkCrawlFlags(ctx); err != nil {
+		return err
+	}
+
 	nodesFile := ctx.String(nodeFileFlag.Name)
 
 	if nodesFile != "" && common.FileExist(nodesFile) {
@@ -111,30 +254,35 @@ func crawlNodes(ctx *cli.Context) error {
 
 	var db *sql.DB
 	if ctx.IsSet(tableNameFlag.Name) {
-		name := ctx.String(tableNameFlag.Name)
-		shouldInit := false
-		if _, err := os.Stat(name); os.IsNotExist(err) {
-			shouldInit = true
-		}
-		var err error
-		if db, err = sql.Open("sqlite3", name); err != nil {
-			panic(err)
+		if db, err = sql.Open("sqlite3", ctx.String(tableNameFlag.Name)); err != nil {
+			return err
 		}
+		defer db.Close()
+		// The topology crawl stores its edges while the next round runs,
+		// and SQLite has a single writer.
+		db.SetMaxOpenConns(1)
 		log.Info("Connected to db")
-		if shouldInit {
-			log.Info("DB did not exist, init")
-			if err := createDB(db); err != nil {
-				panic(err)
-			}
+		if err := migrateDB(db); err != nil {
+			return err
 		}
 	}
+	// Nodes probed before a restart keep their schedule, even if they are
+	// not in the node file.
+	var schedule probeSchedule
+	if db != nil {
+		if schedule, err = loadProbeSchedule(db); err != nil {
+			return err
+		}
+		log.Info("Loaded probe schedule", "nodes", len(schedule))
+	}
 
 	timeout := ctx.Duration(timeoutFlag.Name)
 
 	nodeDB, err := enode.OpenDB(ctx.String(nodedbFlag.Name))
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer nodeDB.Close()
 
 	if geoipFile := ctx.String(geoipdbFlag.Name); geoipFile != "" {
 		geoipDB, err = geoip2.Open(geoipFile)
@@ -144,33 +292,128 @@ func crawlNodes(ctx *cli.Context) error {
 		defer func() { _ = geoipDB.Close() }()
 	}
 
-	for {
-		inputSet = crawlRound(ctx, inputSet, db, geoipDB, nodeDB, timeout)
+	crawlerID := ctx.String(instanceFlag.Name)
+	if crawlerID == "" {
+		if crawlerID, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+	var api *apiClient
+	if url := ctx.String(apiURLFlag.Name); url != "" {
+		api = newAPIClient(url, ctx.String(apiTokenFlag.Name), crawlerID)
+	}
+
+	stop := make(chan struct{})
+	go handleSignals(stop)
+
+	var topology *topologyCrawler
+	if db != nil && ctx.Bool(topologyFlag.Name) {
+		cfg := topologyConfig{
+			Buckets: ctx.Int(topologyBucketsFlag.Name),
+			Workers: ctx.Int(topologyWorkersFlag.Name),
+			Timeout: ctx.Duration(topologyTimeoutFlag.Name),
+		}
+		topology = newTopologyCrawler(cfg, db, crawlerID, stop)
+		defer topology.wait()
+	}
+
+	rounds := ctx.Int(roundsFlag.Name)
+	for round := 1; rounds == 0 || round <= rounds; round++ {
+		log.Info("Starting crawl round", "round", round)
+		inputSet, err = crawlRound(ctx, net, crawlerID, inputSet, schedule, db, api, geoipDB, nodeDB, topology, timeout, stop)
+		if err != nil {
+			return err
+		}
 		if nodesFile != "" {
-			writeNodesJSON(nodesFile, inputSet)
+			if err := writeNodesJSON(nodesFile, inputSet); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-stop:
+			log.Info("Crawler stopped", "rounds", round)
+			return nil
+		default:
+		}
+	}
+	return nil
+}
+
+// checkCrawlFlags rejects flag values the crawler can't run with.
+func checkCrawlFlags(ctx *cli.Context) error {
+	if workers := ctx.Int(workersFlag.Name); workers < 1 {
+		return fmt.Errorf("invalid --%s %d, need at least one worker", workersFlag.Name, workers)
+	}
+	if workers := ctx.Int(exhaustiveWorkersFlag.Name); workers < 1 {
+		return fmt.Errorf("invalid --%s %d, need at least one worker", exhaustiveWorkersFlag.Name, workers)
+	}
+	for _, f := range []cli.IntFlag{queueSizeFlag, backlogSizeFlag} {
+		if v := ctx.Int(f.Name); v < 0 {
+			return fmt.Errorf("invalid --%s %d, must not be negative", f.Name, v)
+		}
+	}
+	for _, f := range []cli.IntFlag{topologyWorkersFlag, topologyBucketsFlag} {
+		if v := ctx.Int(f.Name); v < 1 {
+			return fmt.Errorf("invalid --%s %d, must be at least 1", f.Name, v)
 		}
 	}
+	if strategy := ctx.String(strategyFlag.Name); strategy != "random" && strategy != "exhaustive" {
+		return fmt.Errorf("invalid --%s %q", strategyFlag.Name, strategy)
+	}
+	return nil
 }
 
-func crawlRound(ctx *cli.Context, inputSet nodeSet, db *sql.DB, geoipDB *geoip2.Reader, nodeDB *enode.DB, timeout time.Duration) nodeSet {
-	var v4, v5 nodeSet
-	var wg sync.WaitGroup
+// handleSignals closes stop on the first SIGINT or SIGTERM, which makes the
+// current round wrap up and persist its results. Further signals exit
+// immediately.
+func handleSignals(stop chan struct{}) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+
+	<-sigc
+	log.Info("Got interrupt, finishing crawl round...")
+	close(stop)
+	<-sigc
+	log.Warn("Got second interrupt, exiting without saving")
+	os.Exit(1)
+}
+
+func crawlRound(ctx *cli.Context, net *network, crawlerID string, inputSet nodeSet, schedule probeSchedule, db *sql.DB, api *apiClient, geoipDB *geoip2.Reader, nodeDB *enode.DB, topology *topologyCrawler, timeout time.Duration, stop <-chan struct{}) (nodeSet, error) {
+	var (
+		v4, v5       nodeSet
+		v4Err, v5Err error
+		wg           sync.WaitGroup
+		started      = time.Now()
+	)
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		v5 = discv5(ctx, nodeDB, inputSet, timeout)
-		log.Info("DiscV5", "nodes", len(v5.nodes()))
+		if v5, v5Err = discv5(ctx, net, nodeDB, inputSet, schedule, timeout, stop); v5Err == nil {
+			log.Info("DiscV5", "nodes", len(v5.nodes()))
+			discoveredV5Gauge.Update(int64(len(v5)))
+		}
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		v4 = discv4(ctx, nodeDB, inputSet, timeout)
-		log.Info("DiscV4", "nodes", len(v4.nodes()))
+		if v4, v4Err = discv4(ctx, net, nodeDB, inputSet, schedule, timeout, stop); v4Err == nil {
+			log.Info("DiscV4", "nodes", len(v4.nodes()))
+			discoveredV4Gauge.Update(int64(len(v4)))
+		}
 	}()
 
 	wg.Wait()
+	roundDurationTimer.UpdateSince(started)
+
+	if v5Err != nil {
+		return nil, v5Err
+	}
+	if v4Err != nil {
+		return nil, v4Err
+	}
 
 	output := make(nodeSet, len(v5)+len(v4))
 	for _, n := range v5 {
@@ -187,66 +430,104 @@ func crawlRound(ctx *cli.Context, inputSet nodeSet, db *sql.DB, geoipDB *geoip2.
 
 	// Write the node info to influx
 	if db != nil {
-		if err := updateNodes(db, geoipDB, nodes); err != nil {
-			panic(err)
+		writeStart := time.Now()
+		if err := updateNodes(db, geoipDB, crawlerID, started, nodes); err != nil {
+			return nil, err
+		}
+		dbWriteTimer.UpdateSince(writeStart)
+		if err := dropOldObservations(db, ctx.Duration(historyRetentionFlag.Name)); err != nil {
+			return nil, err
+		}
+		if topology != nil {
+			topology.start(v4.responsive(started), v5.responsive(started))
 		}
 	}
-	return output
+	// An unreachable API must not stop the crawl, the nodes are pushed
+	// again in the next round.
+	if api != nil {
+		if err := api.postNodes(geoipDB, nodes); err != nil {
+			log.Error("Failed to push nodes to API", "err", err)
+		}
+	}
+	return output, nil
 }
 
-func discv5(ctx *cli.Context, db *enode.DB, inputSet nodeSet, timeout time.Duration) nodeSet {
-	ln, config := makeDiscoveryConfig(ctx, db)
+func discv5(ctx *cli.Context, net *network, db *enode.DB, inputSet nodeSet, schedule probeSchedule, timeout time.Duration, stop <-chan struct{}) (nodeSet, error) {
+	ln, config, err := makeDiscoveryConfig(ctx, db, net)
+	if err != nil {
+		return nil, err
+	}
 
-	socket := listen(ln, ctx.String(listenAddrFlag.Name))
+	socket, err := listen(ln, ctx.String(listenAddrFlag.Name))
+	if err != nil {
+		return nil, err
+	}
 
 	disc, err := discover.ListenV5(socket, ln, config)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer disc.Close()
 
-	return runCrawler(ctx, disc, inputSet, timeout)
+	return runCrawler(ctx, net, disc, "v5", config.Bootnodes, inputSet, schedule, timeout, stop), nil
 }
 
-func discv4(ctx *cli.Context, db *enode.DB, inputSet nodeSet, timeout time.Duration) nodeSet {
-	ln, config := makeDiscoveryConfig(ctx, db)
+func discv4(ctx *cli.Context, net *network, db *enode.DB, inputSet nodeSet, schedule probeSchedule, timeout time.Duration, stop <-chan struct{}) (nodeSet, error) {
+	ln, config, err := makeDiscoveryConfig(ctx, db, net)
+	if err != nil {
+		return nil, err
+	}
 
-	socket := listen(ln, ctx.String(listenAddrFlag.Name))
+	socket, err := listen(ln, ctx.String(listenAddrFlag.Name))
+	if err != nil {
+		return nil, err
+	}
 
 	disc, err := discover.ListenV4(socket, ln, config)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer disc.Close()
 
-	return runCrawler(ctx, disc, inputSet, timeout)
+	return runCrawler(ctx, net, disc, "v4", config.Bootnodes, inputSet, schedule, timeout, stop), nil
 }
 
-func runCrawler(ctx *cli.Context, disc resolver, inputSet nodeSet, timeout time.Duration) nodeSet {
-	genesis := makeGenesis(ctx)
-	if genesis == nil {
-		genesis = core.DefaultGenesisBlock()
-	}
-	networkID := ctx.Uint64(utils.NetworkIdFlag.Name)
+func runCrawler(ctx *cli.Context, net *network, disc resolver, protocol string, bootnodes []*enode.Node, inputSet nodeSet, schedule probeSchedule, timeout time.Duration, stop <-chan struct{}) nodeSet {
 	nodeURL := ctx.String(nodeURLFlag.Name)
+	cfg := crawlerConfig{
+		Workers:            ctx.Int(workersFlag.Name),
+		QueueSize:          ctx.Int(queueSizeFlag.Name),
+		BacklogSize:        ctx.Int(backlogSizeFlag.Name),
+		RevalidateInterval: ctx.Duration(revalidateIntervalFlag.Name),
+		ProbeInterval:      ctx.Duration(probeIntervalFlag.Name),
+		Schedule:           schedule,
+		ShutdownGrace:      ctx.Duration(shutdownGraceFlag.Name),
+		Timeouts: probeTimeouts{
+			Dial:   ctx.Duration(dialTimeoutFlag.Name),
+			Hello:  ctx.Duration(helloTimeoutFlag.Name),
+			Status: ctx.Duration(statusTimeoutFlag.Name),
+		},
+	}
 
-	// Crawl the DHT for some time
-	c := newCrawler(genesis, networkID, nodeURL, inputSet, disc, disc.RandomNodes())
-	c.revalidateInterval = 10 * time.Minute
-	return c.run(timeout)
-}
-
-// makeGenesis is the pendant to utils.MakeGenesis
-// with local flags instead of global flags.
-func makeGenesis(ctx *cli.Context) *core.Genesis {
-	switch {
-	case ctx.Bool(utils.RopstenFlag.Name):
-		return core.DefaultRopstenGenesisBlock()
-	case ctx.Bool(utils.RinkebyFlag.Name):
-		return core.DefaultRinkebyGenesisBlock()
-	case ctx.Bool(utils.GoerliFlag.Name):
-		return core.DefaultGoerliGenesisBlock()
-	default:
-		return core.DefaultGenesisBlock()
+	if ctx.String(strategyFlag.Name) != "exhaustive" {
+		// Crawl the DHT for some time
+		c := newCrawler(net, nodeURL, cfg, inputSet, disc, disc.RandomNodes())
+		return c.run(timeout, stop)
 	}
+
+	// Enumerate the routing tables reachable from the bootnodes and the
+	// known nodes, the round ends when no new nodes appear.
+	seeds := append(inputSet.nodes(), bootnodes...)
+	queryTimeout := ctx.Duration(exhaustiveTimeoutFlag.Name)
+	tc := newTableCrawl(protocol, seeds, ctx.Int(exhaustiveWorkersFlag.Name), func(n *enode.Node) (tableQuerier, error) {
+		return newTableQuerier(n, protocol, queryTimeout)
+	})
+	c := newCrawler(net, nodeURL, cfg, inputSet, disc, tc)
+	output := c.run(timeout, stop)
+
+	cov := tc.coverage()
+	log.Info("Routing table crawl done", "protocol", protocol, "queried", cov.Queried, "responded", cov.Responded,
+		"found", cov.Found, "estimated", int(cov.Estimated), "coverage", fmt.Sprintf("%.1f%%", 100*cov.Coverage()))
+	updateCoverage(protocol, cov)
+	return output
 }
@@ -3,12 +3,16 @@ package main
 import (
 	"bytes"
 	"database/sql"
-	"fmt"
+	"strconv"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/forkid"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/p2p/enr"
 
 	beacon "github.com/protolambda/zrnt/eth2/beacon/common"
@@ -17,13 +21,67 @@ import (
 	"github.com/oschwald/geoip2-golang"
 )
 
-func updateNodes(db *sql.DB, geoipDB *geoip2.Reader, nodes []nodeJSON) error {
+// updateNodes stores the latest state of the nodes and appends an observation
+// for every node which was checked since the round started. The probe columns
+// of an observation are NULL if the node was only checked by discovery. Every written
+// node gets a new RowVersion, which consumers use to follow the changes.
+func updateNodes(db *sql.DB, geoipDB *geoip2.Reader, crawlerID string, started time.Time, nodes []nodeJSON) error {
 	log.Info("Writing nodes to db", "nodes", len(nodes))
 	now := time.Now()
 	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec(`INSERT INTO rounds(Started, Finished, Nodes) values(?,?,?)`, started.Unix(), now.Unix(), len(nodes))
+	if err != nil {
+		return err
+	}
+	roundID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	var rowVersion int64
+	if err := tx.QueryRow(`SELECT IFNULL(MAX(RowVersion), 0) FROM nodes`).Scan(&rowVersion); err != nil {
+		return err
+	}
+	obsStmt, err := tx.Prepare(
+		`INSERT INTO observations(RoundID,
+			NodeID,
+			Timestamp,
+			IP,
+			Score,
+			CrawlerID,
+			ClientType,
+			ClientDesc,
+			ClientVersion,
+			OsType,
+			GoVersion,
+			NetworkID,
+			Epoch,
+			Blockheight,
+			HeadHash,
+			ErrorReason,
+			ErrorString,
+			Reachable,
+			Latency,
+			DisconnectReason,
+			HeadTime,
+			EthVersion,
+			OperaVersion,
+			ConnectTime,
+			HandshakeTime,
+			HelloRTT,
+			StatusRTT,
+			PingRTT,
+			HeadVerified)
+			values(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`)
+	if err != nil {
+		return err
+	}
+	defer obsStmt.Close()
+
 	stmt, err := tx.Prepare(
 		`INSERT OR REPLACE into nodes(ID, 
 			Now,
@@ -34,152 +92,377 @@ func updateNodes(db *sql.DB, geoipDB *geoip2.Reader, nodes []nodeJSON) error {
             GoVersion,
 			PK,
 			SoftwareVersion,
-			Capabilities,
 			NetworkID,
-			ForkID,
+			ForkHash,
+			ForkNext,
+			Epoch,
 			Blockheight,
 			TotalDifficulty,
 			HeadHash,
 			IP,
 			Country,
 			City,
-			Coordinates,
+			Latitude,
+			Longitude,
 			FirstSeen,
 			LastSeen,
 			Seq,
 			Score,
 			ConnType,
             ErrorReason,
-            ErrorString) 
-			values(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`)
+            ErrorString,
+			RowVersion,
+			CrawlerID,
+			Reachable,
+			Latency,
+			Name,
+			ENR,
+			TCP,
+			UDP,
+			DisconnectReason,
+			HeadTime,
+			EthVersion,
+			OperaVersion,
+			ConnectTime,
+			HandshakeTime,
+			HelloRTT,
+			StatusRTT,
+			PingRTT,
+			LastProbe,
+			NextProbe,
+			HeadVerified) 
+			values(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`)
 
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	for _, n := range nodes {
-
-		info := &clientInfo{}
-		if n.Info != nil {
-			info = n.Info
-		}
-
-		if info.ClientType == "" {
-			if n.ErrorReason == -1 {
-				info.ClientType = "NA"
-			}
-		}
-		connType := ""
-		var portUDP enr.UDP
-		if n.N.Load(&portUDP) == nil {
-			connType = "UDP"
-		}
-		var portTCP enr.TCP
-		if n.N.Load(&portTCP) == nil {
-			connType = "TCP"
-		}
-		fid := fmt.Sprintf("Hash: %v, Next %v", info.ForkID.Hash, info.ForkID.Next)
-
-		var eth2 ETH2
-		if n.N.Load(&eth2) == nil {
-			info.ClientType = "eth2"
-			var dat beacon.Eth2Data
-			if err := dat.Deserialize(codec.NewDecodingReader(bytes.NewReader(eth2), uint64(len(eth2)))); err == nil {
-				fid = fmt.Sprintf("Hash: %v, Next %v", dat.ForkDigest, dat.NextForkEpoch)
-			}
-		}
-		var caps string
-		for _, c := range info.Capabilities {
-			caps = fmt.Sprintf("%v, %v", caps, c.String())
-		}
-		var pk string
-		if n.N.Pubkey() != nil {
-			pk = fmt.Sprintf("X: %v, Y: %v", n.N.Pubkey().X.String(), n.N.Pubkey().Y.String())
-		}
+	delCapsStmt, err := tx.Prepare(`DELETE FROM node_capabilities WHERE NodeID = ?`)
+	if err != nil {
+		return err
+	}
+	defer delCapsStmt.Close()
+	capsStmt, err := tx.Prepare(`INSERT OR IGNORE INTO node_capabilities(NodeID, Name, Version) values(?,?,?)`)
+	if err != nil {
+		return err
+	}
+	defer capsStmt.Close()
 
-		var country, city, loc string
-		if geoipDB != nil {
-			// parse GeoIp info
-			ipRecord, err := geoipDB.City(n.N.IP())
-			if err != nil {
-				return err
-			}
-			country, city, loc =
-				ipRecord.Country.Names["en"],
-				ipRecord.City.Names["en"],
-				fmt.Sprintf("%v,%v", ipRecord.Location.Latitude, ipRecord.Location.Longitude)
+	for _, n := range nodes {
+		r, err := makeNodeRecord(geoipDB, n)
+		if err != nil {
+			return err
 		}
+		info := r.Info
+		forkHash, forkNext := r.forkID()
 
+		rowVersion++
 		_, err = stmt.Exec(
 			n.N.ID().String(),
-			now.String(),
+			now.Unix(),
 			info.ClientType,
 			info.ClientDesc,
 			info.ClientVersion,
 			info.OsType,
 			info.GoVersion,
-			pk,
+			r.PK,
 			info.SoftwareVersion,
-			caps,
 			info.NetworkID,
-			fid,
+			forkHash,
+			forkNext,
+			info.Epoch,
 			info.Blockheight,
 			info.TotalDifficulty.String(),
 			info.HeadHash.String(),
 			n.N.IP().String(),
-			country,
-			city,
-			loc,
-			n.FirstResponse.String(),
-			n.LastResponse.String(),
+			r.Country,
+			r.City,
+			r.Latitude,
+			r.Longitude,
+			unixTime(n.FirstResponse),
+			unixTime(n.LastResponse),
 			n.Seq,
 			n.Score,
-			connType,
+			r.ConnType,
 			n.ErrorReason,
 			n.ErrorString,
+			rowVersion,
+			crawlerID,
+			n.Reachable,
+			n.Latency.Milliseconds(),
+			info.Name,
+			r.ENR,
+			n.N.TCP(),
+			n.N.UDP(),
+			disconnectReason(n),
+			headTime(info),
+			info.EthVersion,
+			info.OperaVersion,
+			milliseconds(n.Timings.Connect),
+			milliseconds(n.Timings.Handshake),
+			milliseconds(n.Timings.Hello),
+			milliseconds(n.Timings.Status),
+			milliseconds(n.Timings.Ping),
+			unixTime(n.LastProbe),
+			unixTime(n.NextProbe),
+			info.HeadVerified,
 		)
 		if err != nil {
 			return err
 		}
+		if _, err := delCapsStmt.Exec(n.N.ID().String()); err != nil {
+			return err
+		}
+		for _, c := range info.Capabilities {
+			if _, err := capsStmt.Exec(n.N.ID().String(), c.Name, c.Version); err != nil {
+				return err
+			}
+		}
+
+		// Nodes carried over from the input set without being checked
+		// in this round were not observed.
+		if n.LastCheck.Before(started.Truncate(time.Second)) {
+			continue
+		}
+		// Nodes which were only checked by discovery keep the results of
+		// an older probe, which must not be observed again.
+		probe := make([]interface{}, 23)
+		if !n.LastProbe.Before(started.Truncate(time.Second)) {
+			probe = []interface{}{
+				info.ClientType,
+				info.ClientDesc,
+				info.ClientVersion,
+				info.OsType,
+				info.GoVersion,
+				info.NetworkID,
+				info.Epoch,
+				info.Blockheight,
+				info.HeadHash.String(),
+				n.ErrorReason,
+				n.ErrorString,
+				n.Reachable,
+				n.Latency.Milliseconds(),
+				disconnectReason(n),
+				headTime(info),
+				info.EthVersion,
+				info.OperaVersion,
+				milliseconds(n.Timings.Connect),
+				milliseconds(n.Timings.Handshake),
+				milliseconds(n.Timings.Hello),
+				milliseconds(n.Timings.Status),
+				milliseconds(n.Timings.Ping),
+				info.HeadVerified,
+			}
+		}
+		args := append([]interface{}{
+			roundID,
+			n.N.ID().String(),
+			n.LastCheck.Unix(),
+			n.N.IP().String(),
+			n.Score,
+			crawlerID,
+		}, probe...)
+		if _, err = obsStmt.Exec(args...); err != nil {
+			return err
+		}
 	}
 
 	return tx.Commit()
 }
 
-func createDB(db *sql.DB) error {
-	sqlStmt := `
-	CREATE TABLE nodes (
-		ID text not null, 
-		Now text not null,
-		ClientType text,
-		ClientDesc text,
-		ClientVersion text,
-		OsType text,
-        GoVersion text,
-		PK text,
-		SoftwareVersion text,
-		Capabilities text,
-		NetworkID number,
-		ForkID text,
-		Blockheight text,
-		TotalDifficulty text,
-		HeadHash text,
-		IP text,
-		Country text,
-		City text,
-		Coordinates text,
-		FirstSeen text,
-		LastSeen text,
-		Seq number,
-		Score number,
-		ConnType text,
-		ErrorReason number,
-		ErrorString text,
-		PRIMARY KEY (ID)
-	);
-	delete from nodes;
-	`
-	_, err := db.Exec(sqlStmt)
-	return err
+// loadProbeSchedule returns the next probe times of the nodes which are not
+// due yet.
+func loadProbeSchedule(db *sql.DB) (probeSchedule, error) {
+	rows, err := db.Query(`SELECT ID, NextProbe FROM nodes WHERE NextProbe > ?`, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedule := make(probeSchedule)
+	for rows.Next() {
+		var (
+			id   string
+			next int64
+		)
+		if err := rows.Scan(&id, &next); err != nil {
+			return nil, err
+		}
+		nodeID, err := enode.ParseID(id)
+		if err != nil {
+			log.Warn("Skipping invalid node ID", "id", id, "err", err)
+			continue
+		}
+		schedule[nodeID] = time.Unix(next, 0).UTC()
+	}
+	return schedule, rows.Err()
+}
+
+// updateEdges stores the edges of the discovery topology found in a round.
+func updateEdges(db *sql.DB, crawlerID string, edges []topologyEdge) error {
+	now := time.Now().Unix()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.Prepare(
+		`INSERT INTO edges(FromID, ToID, Protocol, Distance, CrawlerID, FirstSeen, LastSeen)
+			values(?,?,?,?,?,?,?) ON CONFLICT(FromID, ToID, Protocol) DO UPDATE SET
+			CrawlerID=excluded.CrawlerID,
+			LastSeen=excluded.LastSeen`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range edges {
+		if _, err := stmt.Exec(e.From.String(), e.To.String(), e.Protocol, e.Distance, crawlerID, now, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// nodeRecord is the flattened form of a crawled node, as it is stored in the
+// database and pushed to the API.
+type nodeRecord struct {
+	Info      *clientInfo
+	PK        string
+	ForkHash  string // empty if unknown
+	ForkNext  uint64
+	ENR       string
+	ConnType  string
+	Country   string
+	City      string
+	Latitude  *float64 // nil if unknown
+	Longitude *float64 // nil if unknown
+	// HeadNumber is the number of the head block, 0 if unknown.
+	HeadNumber uint64
+}
+
+func makeNodeRecord(geoipDB *geoip2.Reader, n nodeJSON) (*nodeRecord, error) {
+	var r nodeRecord
+
+	info := &clientInfo{}
+	if n.Info != nil {
+		info = n.Info
+	}
+
+	if info.ClientType == "" {
+		if n.ErrorReason != 0 {
+			info.ClientType = "NA"
+		}
+	}
+	r.Info = info
+	r.ENR = n.N.String()
+
+	var portUDP enr.UDP
+	if n.N.Load(&portUDP) == nil {
+		r.ConnType = "UDP"
+	}
+	var portTCP enr.TCP
+	if n.N.Load(&portTCP) == nil {
+		r.ConnType = "TCP"
+	}
+	// Peers which don't send a fork ID, like all opera peers, have none.
+	if info.ForkID != (forkid.ID{}) {
+		r.ForkHash, r.ForkNext = hexutil.Encode(info.ForkID.Hash[:]), info.ForkID.Next
+	}
+	r.HeadNumber, _ = strconv.ParseUint(info.Blockheight, 10, 64)
+
+	var eth2 ETH2
+	if n.N.Load(&eth2) == nil {
+		info.ClientType = "eth2"
+		var dat beacon.Eth2Data
+		if err := dat.Deserialize(codec.NewDecodingReader(bytes.NewReader(eth2), uint64(len(eth2)))); err == nil {
+			r.ForkHash, r.ForkNext = hexutil.Encode(dat.ForkDigest[:]), uint64(dat.NextForkEpoch)
+		}
+	}
+	if n.N.Pubkey() != nil {
+		r.PK = hexutil.Encode(crypto.CompressPubkey(n.N.Pubkey()))
+	}
+
+	if geoipDB != nil {
+		// parse GeoIp info
+		ipRecord, err := geoipDB.City(n.N.IP())
+		if err != nil {
+			return nil, err
+		}
+		r.Country, r.City, r.Latitude, r.Longitude =
+			ipRecord.Country.Names["en"],
+			ipRecord.City.Names["en"],
+			&ipRecord.Location.Latitude,
+			&ipRecord.Location.Longitude
+	}
+	return &r, nil
+}
+
+// forkID returns the fork hash and next as stored in the database, nil if
+// the fork ID is unknown.
+func (r *nodeRecord) forkID() (interface{}, interface{}) {
+	if r.ForkHash == "" {
+		return nil, nil
+	}
+	return r.ForkHash, r.ForkNext
+}
+
+// disconnectReason returns the disconnect reason of the node as stored in
+// the database, nil if it didn't disconnect.
+func disconnectReason(n nodeJSON) interface{} {
+	if n.DisconnectReason == nil {
+		return nil
+	}
+	return uint64(*n.DisconnectReason)
+}
+
+// headTime returns the timestamp of the node's head block as stored in the
+// database, nil if it is unknown.
+func headTime(info *clientInfo) interface{} {
+	if info.HeadTime == 0 {
+		return nil
+	}
+	return info.HeadTime
+}
+
+// milliseconds returns d in milliseconds, nil if the duration wasn't
+// measured.
+func milliseconds(d time.Duration) *float64 {
+	if d == 0 {
+		return nil
+	}
+	ms := float64(d) / float64(time.Millisecond)
+	return &ms
+}
+
+// unixTime returns t as unix timestamp, or nil for the zero time.
+func unixTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Unix()
+}
+
+// dropOldObservations deletes observations and rounds older than the given
+// retention period. A zero retention keeps the history forever.
+func dropOldObservations(db *sql.DB, retention time.Duration) error {
+	if retention == 0 {
+		return nil
+	}
+	oldest := time.Now().Add(-retention).Unix()
+	res, err := db.Exec(`DELETE FROM observations WHERE Timestamp < ?`, oldest)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(`DELETE FROM rounds WHERE Finished < ?`, oldest); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`DELETE FROM edges WHERE LastSeen < ?`, oldest); err != nil {
+		return err
+	}
+	affected, _ := res.RowsAffected()
+	log.Info("Dropped old observations", "count", affected)
+	return nil
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/ethereum/go-ethereum/p2p"
+)
+
+// probeErrorCode classifies why a probe failed. It is stored as the error
+// reason of a node, zero means the probe succeeded.
+type probeErrorCode int
+
+const (
+	errCodeNone             probeErrorCode = 0
+	errCodeUnknown          probeErrorCode = -1 // unclassified, also all failures recorded before classification
+	errCodeDialRefused      probeErrorCode = 1  // TCP connection refused or unreachable
+	errCodeDialTimeout      probeErrorCode = 2  // TCP connect timed out
+	errCodeHandshake        probeErrorCode = 3  // RLPx handshake failed
+	errCodeTooManyPeers     probeErrorCode = 4  // disconnected with DiscTooManyPeers
+	errCodeUselessPeer      probeErrorCode = 5  // disconnected with DiscUselessPeer
+	errCodeWrongNetwork     probeErrorCode = 6  // peer is on another network or has another genesis
+	errCodeProtocolMismatch probeErrorCode = 7  // incompatible protocol version or unexpected message
+	errCodeDecode           probeErrorCode = 8  // undecodable message
+	errCodeStatusTimeout    probeErrorCode = 9  // no status or opera handshake in time
+	errCodeHelloTimeout     probeErrorCode = 10 // no Hello in time
+)
+
+var probeErrorNames = map[probeErrorCode]string{
+	errCodeNone:             "none",
+	errCodeUnknown:          "unknown",
+	errCodeDialRefused:      "dial_refused",
+	errCodeDialTimeout:      "dial_timeout",
+	errCodeHandshake:        "handshake_failed",
+	errCodeTooManyPeers:     "too_many_peers",
+	errCodeUselessPeer:      "useless_peer",
+	errCodeWrongNetwork:     "wrong_network",
+	errCodeProtocolMismatch: "protocol_mismatch",
+	errCodeDecode:           "decode_error",
+	errCodeStatusTimeout:    "status_timeout",
+	errCodeHelloTimeout:     "hello_timeout",
+}
+
+func (c probeErrorCode) String() string {
+	if name, ok := probeErrorNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("code_%d", int(c))
+}
+
+// errDecode marks messages which could not be decoded.
+var errDecode = errors.New("could not rlp decode message")
+
+// probeError is a classified probe failure.
+type probeError struct {
+	Code probeErrorCode
+	Err  error
+	// Disconnect is the reason sent by the peer if it disconnected.
+	Disconnect *p2p.DiscReason
+}
+
+func (e *probeError) Error() string { return e.Err.Error() }
+func (e *probeError) Unwrap() error { return e.Err }
+
+// probeErrorCodeOf returns the classification of a probe error.
+func probeErrorCodeOf(err error) probeErrorCode {
+	if err == nil {
+		return errCodeNone
+	}
+	var pe *probeError
+	if errors.As(err, &pe) {
+		return pe.Code
+	}
+	return errCodeUnknown
+}
+
+// disconnectReasonOf returns the disconnect reason sent by the peer, nil if
+// it didn't disconnect.
+func disconnectReasonOf(err error) *p2p.DiscReason {
+	var pe *probeError
+	if errors.As(err, &pe) {
+		return pe.Disconnect
+	}
+	return nil
+}
+
+// dialError classifies a failed TCP connect.
+func dialError(err error) error {
+	code := errCodeDialRefused
+	if isTimeout(err) {
+		code = errCodeDialTimeout
+	}
+	return &probeError{Code: code, Err: err}
+}
+
+// unexpectedMessage classifies the message received instead of the one
+// expected in a handshake stage. Timeouts of the stage get timeoutCode.
+func unexpectedMessage(what string, msg Message, timeoutCode probeErrorCode) error {
+	switch msg := msg.(type) {
+	case *Disconnect:
+		reason := msg.Reason
+		return &probeError{Code: disconnectCode(reason), Err: fmt.Errorf("%v: %v", what, reason.Error()), Disconnect: &reason}
+	case *Error:
+		code := errCodeUnknown
+		switch {
+		case errors.Is(msg, errDecode):
+			code = errCodeDecode
+		case isTimeout(msg):
+			code = timeoutCode
+		}
+		return &probeError{Code: code, Err: fmt.Errorf("%v: %v", what, msg.Error())}
+	default:
+		return &probeError{Code: errCodeProtocolMismatch, Err: fmt.Errorf("%v: %v", what, msg.Code())}
+	}
+}
+
+func disconnectCode(reason p2p.DiscReason) probeErrorCode {
+	switch reason {
+	case p2p.DiscTooManyPeers:
+		return errCodeTooManyPeers
+	case p2p.DiscUselessPeer:
+		return errCodeUselessPeer
+	case p2p.DiscIncompatibleVersion:
+		return errCodeProtocolMismatch
+	default:
+		return errCodeUnknown
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p"
+)
+
+// readTimeout returns the error of a read which timed out, wrapped like
+// Conn.Read does.
+func readTimeout(t *testing.T) *Error {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	c1.SetReadDeadline(time.Now())
+	_, err := c1.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("read didn't time out")
+	}
+	return errorf("could not read from connection: %w", err)
+}
+
+// dialClosedPort returns the error of a TCP connect to a closed port.
+func dialClosedPort(t *testing.T) error {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	conn, err := net.Dial("tcp", addr)
+	if err == nil {
+		conn.Close()
+		t.Fatal("dial to closed port succeeded")
+	}
+	return err
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestProbeErrorCodes(t *testing.T) {
+	tooManyPeers := p2p.DiscTooManyPeers
+	tests := []struct {
+		name       string
+		err        error
+		code       probeErrorCode
+		disconnect *p2p.DiscReason
+	}{
+		{name: "none", err: nil, code: errCodeNone},
+		{name: "unclassified", err: errors.New("boom"), code: errCodeUnknown},
+		{name: "wrapped probe error", err: fmt.Errorf("probe: %w", &probeError{Code: errCodeWrongNetwork, Err: errors.New("genesis")}), code: errCodeWrongNetwork},
+
+		{name: "dial refused", err: dialError(dialClosedPort(t)), code: errCodeDialRefused},
+		{name: "dial timeout", err: dialError(&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}), code: errCodeDialTimeout},
+
+		{name: "disconnect too many peers", err: unexpectedMessage("hello", &Disconnect{Reason: p2p.DiscTooManyPeers}, errCodeHelloTimeout), code: errCodeTooManyPeers, disconnect: &tooManyPeers},
+		{name: "disconnect useless peer", err: unexpectedMessage("status", &Disconnect{Reason: p2p.DiscUselessPeer}, errCodeStatusTimeout), code: errCodeUselessPeer},
+		{name: "disconnect incompatible version", err: unexpectedMessage("status", &Disconnect{Reason: p2p.DiscIncompatibleVersion}, errCodeStatusTimeout), code: errCodeProtocolMismatch},
+		{name: "disconnect requested", err: unexpectedMessage("status", &Disconnect{Reason: p2p.DiscRequested}, errCodeStatusTimeout), code: errCodeUnknown},
+		{name: "decode error", err: unexpectedMessage("status", errorf("%w: %v", errDecode, "rlp: too few elements"), errCodeStatusTimeout), code: errCodeDecode},
+		{name: "hello read timeout", err: unexpectedMessage("hello", readTimeout(t), errCodeHelloTimeout), code: errCodeHelloTimeout},
+		{name: "status read timeout", err: unexpectedMessage("status", readTimeout(t), errCodeStatusTimeout), code: errCodeStatusTimeout},
+		{name: "read error", err: unexpectedMessage("status", errorf("could not read from connection: %w", errors.New("EOF")), errCodeStatusTimeout), code: errCodeUnknown},
+		{name: "unexpected message", err: unexpectedMessage("status", &Ping{}, errCodeStatusTimeout), code: errCodeProtocolMismatch},
+	}
+	for _, test := range tests {
+		if code := probeErrorCodeOf(test.err); code != test.code {
+			t.Errorf("%s: got code %v, want %v", test.name, code, test.code)
+		}
+		if test.disconnect != nil {
+			if got := disconnectReasonOf(test.err); got == nil || *got != *test.disconnect {
+				t.Errorf("%s: got disconnect reason %v, want %v", test.name, got, *test.disconnect)
+			}
+		}
+	}
+}
@@ -6,29 +6,51 @@ import (
 	"fmt"
 	"math/big"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/forkid"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth/protocols/eth"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/p2p/rlpx"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
 
 	"github.com/pkg/errors"
 )
 
 var (
-	_status          *Status
-	lastStatusUpdate time.Time
+	_status            *Status
+	// _highestTD is the highest TD announced by a peer. It is tracked
+	// apart from _status, which is only built once the genesis is known.
+	_highestTD         *big.Int
+	_progress          *OperaProgress
+	lastStatusUpdate   time.Time
+	lastProgressUpdate time.Time
+	// _ethGenesis caches the genesis hash read from --nodeURL.
+	_ethGenesis         common.Hash
+	lastEthGenesisFetch time.Time
+	statusLock          sync.Mutex
+)
+
+const (
+	// headRefreshInterval is how often the announced head follows the
+	// node given with --nodeURL.
+	headRefreshInterval = 15 * time.Second
+	// rpcTimeout bounds the requests to the node given with --nodeURL.
+	rpcTimeout = 5 * time.Second
 )
 
 type clientInfo struct {
+	Name            string // raw client name from the Hello message
 	ClientType      string
 	ClientVersion   string
 	ClientDesc      string
@@ -36,54 +58,136 @@ type clientInfo struct {
 	GoVersion       string
 	SoftwareVersion uint64
 	Capabilities    []p2p.Cap
+	EthVersion      uint // negotiated eth version, 0 if none
+	OperaVersion    uint // negotiated opera version, 0 if none
 	NetworkID       uint64
 	ForkID          forkid.ID
+	Epoch           uint32
 	Blockheight     string
+	HeadTime        uint64 // timestamp of the head block, 0 if unknown
+	// HeadVerified is set if the node served its head block or, for opera
+	// peers, the head matches the block of --nodeURL.
+	HeadVerified    bool
 	TotalDifficulty *big.Int
 	HeadHash        common.Hash
 }
 
-func getClientInfo(genesis *core.Genesis, networkID uint64, nodeURL string, n *enode.Node) (*clientInfo, error) {
+// headRequestID tags the eth/66 header request for the head block.
+const headRequestID = 1
+
+// probeTimeouts bounds the stages of a node probe.
+type probeTimeouts struct {
+	Dial   time.Duration // TCP connect and RLPx handshake
+	Hello  time.Duration // Hello exchange
+	Status time.Duration // opera handshake or eth Status exchange
+}
+
+// probeTimings are the durations of the stages of a node probe. Stages which
+// weren't reached are zero.
+type probeTimings struct {
+	Connect   time.Duration `json:"connect,omitempty"`   // TCP connect
+	Handshake time.Duration `json:"handshake,omitempty"` // RLPx handshake
+	Hello     time.Duration `json:"hello,omitempty"`     // Hello round trip
+	Status    time.Duration `json:"status,omitempty"`    // Status or opera handshake round trip
+	Ping      time.Duration `json:"ping,omitempty"`      // discovery PING/PONG round trip
+}
+
+// probe is the time the node took to answer the probe up to its status. The
+// discovery ping, which runs alongside, and the calls to --nodeURL are left out.
+func (t probeTimings) probe() time.Duration {
+	return t.Connect + t.Handshake + t.Hello + t.Status
+}
+
+func getClientInfo(net *network, nodeURL string, timeouts probeTimeouts, n *enode.Node, timings *probeTimings) (*clientInfo, error) {
 	var info clientInfo
 
-	conn, sk, err := dial(n)
+	conn, sk, err := dial(n, timeouts.Dial, timings)
 	if err != nil {
 		return &info, errors.Wrap(err, "couldNotDial: ")
 	}
 	defer conn.Close()
 
-	if err = conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+	if err = conn.SetDeadline(time.Now().Add(timeouts.Hello)); err != nil {
 		return &info, errors.Wrap(err, "cannot set conn deadline for hello")
 	}
 
+	start := time.Now()
 	if err = writeHello(conn, sk); err != nil {
 		return &info, errors.Wrap(err, "writeHelloFailure")
 	}
 	if err = readHello(conn, &info); err != nil {
 		return &info, errors.Wrap(err, "readHelloFailure")
 	}
+	timings.Hello = time.Since(start)
 
-	// If node provides no eth version, we can skip it.
-	if conn.negotiatedProtoVersion == 0 {
+	// If node provides neither opera nor eth version, we can skip it.
+	if conn.operaProtoVersion == 0 && conn.negotiatedProtoVersion == 0 {
 		return &info, nil
 	}
 
-	if err = conn.SetDeadline(time.Now().Add(15 * time.Second)); err != nil {
+	if err = conn.SetDeadline(time.Now().Add(timeouts.Status)); err != nil {
 		log.Warn("SetDeadline-2: " + err.Error())
 		return &info, errors.Wrap(err, "cannot set conn deadline for status")
 	}
 
-	s := getStatus(genesis.Config, uint32(conn.negotiatedProtoVersion), genesis.ToBlock(nil).Hash(), networkID, nodeURL)
-	if err = conn.Write(s); err != nil {
-		return &info, errors.Wrap(err, "getStatusError")
+	// Opera nodes only speak the opera protocol, the eth Status exchange
+	// is kept for peers which don't.
+	// Our messages are prepared before the timer starts, they may need a
+	// call to --nodeURL.
+	if conn.operaProtoVersion > 0 {
+		h := &OperaHandshake{
+			ProtocolVersion: uint32(conn.operaProtoVersion),
+			NetworkID:       net.NetworkID,
+			Genesis:         net.Genesis,
+		}
+		progress := getProgress(nodeURL)
+		start = time.Now()
+		if err = conn.Write(h); err != nil {
+			return &info, errors.Wrap(err, "writeHandshakeError")
+		}
+		if err = conn.Write(progress); err != nil {
+			return &info, errors.Wrap(err, "writeProgressError")
+		}
+		if err = readOperaHandshake(conn, net, &info); err != nil {
+			return &info, errors.Wrap(err, "readHandshakeError")
+		}
+		timings.Status = time.Since(start)
+		if err = readOperaProgress(conn, &info); err != nil {
+			return &info, errors.Wrap(err, "readProgressError")
+		}
+		_ = conn.Write(Disconnect{Reason: p2p.DiscQuitting})
+		verifyOperaHead(nodeURL, &info)
+		return &info, nil
+	}
+
+	// Without the eth genesis hash, peers would reject our Status, but
+	// they still send theirs.
+	var status *Status
+	if genesis := ethGenesis(net, nodeURL); genesis != (common.Hash{}) {
+		status = getStatus(net.Config, uint32(conn.negotiatedProtoVersion), genesis, net.NetworkID, nodeURL)
+	}
+	start = time.Now()
+	if status != nil {
+		if err = conn.Write(status); err != nil {
+			return &info, errors.Wrap(err, "getStatusError")
+		}
 	}
 
 	// Regardless of whether we wrote a status message or not, the remote side
 	// might still send us one.
 
-	if err = readStatus(conn, &info); err != nil {
+	if err = readStatus(conn, net, &info); err != nil {
 		return &info, errors.Wrap(err, "readStatusError")
 	}
+	timings.Status = time.Since(start)
+
+	// The advertised head is only trusted once the peer serves its header.
+	if err = conn.SetDeadline(time.Now().Add(timeouts.Status)); err != nil {
+		return &info, errors.Wrap(err, "cannot set conn deadline for headers")
+	}
+	if err = readHead(conn, &info); err != nil {
+		log.Debug("Could not verify head", "err", err, "head", info.HeadHash, "id", n.ID())
+	}
 
 	// Disconnect from client
 	_ = conn.Write(Disconnect{Reason: p2p.DiscQuitting})
@@ -92,28 +196,33 @@ func getClientInfo(genesis *core.Genesis, networkID uint64, nodeURL string, n *e
 }
 
 // dial attempts to dial the given node and perform a handshake,
-func dial(n *enode.Node) (*Conn, *ecdsa.PrivateKey, error) {
+func dial(n *enode.Node, timeout time.Duration, timings *probeTimings) (*Conn, *ecdsa.PrivateKey, error) {
 	var conn Conn
 
 	// dial
-	fd, err := net.Dial("tcp", fmt.Sprintf("%v:%d", n.IP(), n.TCP()))
+	start := time.Now()
+	fd, err := net.DialTimeout("tcp", fmt.Sprintf("%v:%d", n.IP(), n.TCP()), timeout)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, dialError(err)
 	}
+	timings.Connect = time.Since(start)
 
 	conn.Conn = rlpx.NewConn(fd, n.Pubkey())
 
-	if err = conn.SetDeadline(time.Now().Add(15 * time.Second)); err != nil {
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
 		return nil, nil, errors.Wrap(err, "cannot set conn deadline")
 	}
 
 	// do encHandshake
 	ourKey, _ := crypto.GenerateKey()
 
+	start = time.Now()
 	_, err = conn.Handshake(ourKey)
 	if err != nil {
-		return nil, nil, err
+		conn.Close()
+		return nil, nil, &probeError{Code: errCodeHandshake, Err: err}
 	}
+	timings.Handshake = time.Since(start)
 
 	return &conn, ourKey, nil
 }
@@ -124,19 +233,19 @@ func writeHello(conn *Conn, priv *ecdsa.PrivateKey) error {
 	h := &Hello{
 		Version: 5,
 		Caps: []p2p.Cap{
-			{Name: "diff", Version: 1},
 			{Name: "eth", Version: 64},
 			{Name: "eth", Version: 65},
 			{Name: "eth", Version: 66},
-			{Name: "les", Version: 2},
-			{Name: "les", Version: 3},
-			{Name: "les", Version: 4},
-			{Name: "snap", Version: 1},
+			{Name: "eth", Version: 67},
+			{Name: "eth", Version: 68},
+			{Name: operaProtocolName, Version: 62},
+			{Name: operaProtocolName, Version: 63},
 		},
 		ID: pub0,
 	}
 
-	conn.ourHighestProtoVersion = 66
+	conn.ourHighestProtoVersion = 68
+	conn.ourHighestOperaVersion = 63
 
 	return conn.Write(h)
 }
@@ -148,6 +257,7 @@ func readHello(conn *Conn, info *clientInfo) error {
 		if msg.Version >= 5 {
 			conn.SetSnappy(true)
 		}
+		info.Name = msg.Name
 		info.Capabilities = msg.Caps
 		info.SoftwareVersion = msg.Version
 
@@ -177,20 +287,22 @@ func readHello(conn *Conn, info *clientInfo) error {
 			info.OsType = ""
 			info.GoVersion = ""
 		}
-	case *Disconnect:
-		return fmt.Errorf("bad hello handshake: %v", msg.Reason.Error())
-	case *Error:
-		return fmt.Errorf("bad hello handshake: %v", msg.Error())
 	default:
-		return fmt.Errorf("bad hello handshake: %v", msg.Code())
+		return unexpectedMessage("bad hello handshake", msg, errCodeHelloTimeout)
 	}
 
 	conn.negotiateEthProtocol(info.Capabilities)
+	conn.negotiateOperaProtocol(info.Capabilities)
+	info.EthVersion = conn.negotiatedProtoVersion
+	info.OperaVersion = conn.operaProtoVersion
 
 	return nil
 }
 
 func getStatus(config *params.ChainConfig, version uint32, genesis common.Hash, network uint64, nodeURL string) *Status {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+
 	if _status == nil {
 		_status = &Status{
 			ProtocolVersion: version,
@@ -202,27 +314,204 @@ func getStatus(config *params.ChainConfig, version uint32, genesis common.Hash,
 		}
 	}
 
-	if nodeURL != "" && time.Since(lastStatusUpdate) > 15*time.Second {
-		cl, err := ethclient.Dial(nodeURL)
+	if nodeURL != "" && time.Since(lastStatusUpdate) > headRefreshInterval {
+		updateStatusHead(config, genesis, nodeURL)
+	}
+
+	// The status is shared by all probes, but peers negotiate different
+	// eth versions.
+	status := *_status
+	status.ProtocolVersion = version
+	if _highestTD != nil {
+		status.TD = _highestTD
+	}
+	return &status
+}
+
+// ethGenesis returns the hash of the genesis block announced in the eth
+// Status, the zero hash if it is unknown. Unless the network defines it, it
+// is read from the node at nodeURL once.
+func ethGenesis(net *network, nodeURL string) common.Hash {
+	if net.EthGenesis != (common.Hash{}) || nodeURL == "" {
+		return net.EthGenesis
+	}
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	if _ethGenesis == (common.Hash{}) && time.Since(lastEthGenesisFetch) > headRefreshInterval {
+		lastEthGenesisFetch = time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+		defer cancel()
+		cl, err := ethclient.DialContext(ctx, nodeURL)
 		if err != nil {
 			log.Error("ethclient.Dial", "err", err)
-			return _status
+			return _ethGenesis
 		}
-
-		header, err := cl.HeaderByNumber(context.Background(), nil)
+		defer cl.Close()
+		header, err := cl.HeaderByNumber(ctx, common.Big0)
 		if err != nil {
-			log.Error("cannot get header by number", "err", err)
-			return _status
+			log.Error("Cannot get genesis header", "err", err)
+			return _ethGenesis
+		}
+		_ethGenesis = header.Hash()
+	}
+	return _ethGenesis
+}
+
+// updateStatusHead sets the head of the status we announce to the head of
+// the configured node. The caller must hold statusLock.
+func updateStatusHead(config *params.ChainConfig, genesis common.Hash, nodeURL string) {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+
+	cl, err := ethclient.DialContext(ctx, nodeURL)
+	if err != nil {
+		log.Error("ethclient.Dial", "err", err)
+		return
+	}
+	defer cl.Close()
+
+	header, err := cl.HeaderByNumber(ctx, nil)
+	if err != nil {
+		log.Error("cannot get header by number", "err", err)
+		return
+	}
+
+	_status.Head = header.Hash()
+	_status.ForkID = forkid.NewID(config, genesis, header.Number.Uint64())
+	lastStatusUpdate = time.Now()
+}
+
+// getProgress returns the synchronization status we announce to opera peers.
+// If a node URL is configured, the progress follows the head of that node.
+// The node is queried without holding statusLock, so a slow node doesn't
+// stall the other probes.
+func getProgress(nodeURL string) *OperaProgress {
+	statusLock.Lock()
+	if _progress == nil {
+		_progress = new(OperaProgress)
+	}
+	refresh := nodeURL != "" && time.Since(lastProgressUpdate) > headRefreshInterval
+	if refresh {
+		// Other probes keep announcing the old progress meanwhile.
+		lastProgressUpdate = time.Now()
+	}
+	statusLock.Unlock()
+
+	if refresh {
+		if progress, err := fetchProgress(nodeURL); err != nil {
+			log.Error("Cannot get progress", "url", nodeURL, "err", err)
+		} else {
+			statusLock.Lock()
+			_progress = progress
+			statusLock.Unlock()
 		}
+	}
+
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	progress := *_progress
+	return &progress
+}
+
+// fetchProgress returns the progress of the node at nodeURL.
+func fetchProgress(nodeURL string) (*OperaProgress, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+
+	rc, err := rpc.DialContext(ctx, nodeURL)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
 
-		_status.Head = header.Hash()
-		_status.ForkID = forkid.NewID(config, genesis, header.Number.Uint64())
+	header, err := ethclient.NewClient(rc).HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get header by number")
 	}
+	var epoch hexutil.Uint64
+	if err := rc.CallContext(ctx, &epoch, "ftm_currentEpoch"); err != nil {
+		return nil, errors.Wrap(err, "cannot get current epoch")
+	}
+
+	// The block hash of an opera block is the ID of its atropos event.
+	return &OperaProgress{
+		Epoch:            uint32(epoch),
+		LastBlockIdx:     header.Number.Uint64(),
+		LastBlockAtropos: header.Hash(),
+	}, nil
+}
+
+// maxOperaBlocks bounds the cache of blocks used to verify opera heads.
+const maxOperaBlocks = 1024
+
+// operaBlock is a block of --nodeURL, as far as needed to verify the head
+// of an opera peer.
+type operaBlock struct {
+	Hash common.Hash    `json:"hash"` // ID of the atropos event
+	Time hexutil.Uint64 `json:"timestamp"`
+}
+
+var (
+	operaBlocks     = make(map[uint64]*operaBlock)
+	operaBlocksLock sync.Mutex
+)
 
-	return _status
+// verifyOperaHead checks the head announced in the progress message of an
+// opera peer against the block of --nodeURL with the same number. Heads
+// beyond the block of --nodeURL stay unverified.
+func verifyOperaHead(nodeURL string, info *clientInfo) {
+	if nodeURL == "" || info.Blockheight == "" {
+		return
+	}
+	number, err := strconv.ParseUint(info.Blockheight, 10, 64)
+	if err != nil {
+		return
+	}
+	block, err := fetchOperaBlock(nodeURL, number)
+	if err != nil {
+		log.Debug("Cannot verify opera head", "number", number, "err", err)
+		return
+	}
+	if block.Hash == info.HeadHash {
+		info.HeadTime = uint64(block.Time)
+		info.HeadVerified = true
+	}
+}
+
+// fetchOperaBlock returns the block with the given number from nodeURL.
+// Blocks are cached, most peers announce the same few heads.
+func fetchOperaBlock(nodeURL string, number uint64) (*operaBlock, error) {
+	operaBlocksLock.Lock()
+	block, ok := operaBlocks[number]
+	operaBlocksLock.Unlock()
+	if ok {
+		return block, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+	rc, err := rpc.DialContext(ctx, nodeURL)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if err := rc.CallContext(ctx, &block, "eth_getBlockByNumber", hexutil.EncodeUint64(number), false); err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, fmt.Errorf("block %d not found", number)
+	}
+
+	operaBlocksLock.Lock()
+	defer operaBlocksLock.Unlock()
+	if len(operaBlocks) >= maxOperaBlocks {
+		operaBlocks = make(map[uint64]*operaBlock)
+	}
+	operaBlocks[number] = block
+	return block, nil
 }
 
-func readStatus(conn *Conn, info *clientInfo) error {
+func readStatus(conn *Conn, net *network, info *clientInfo) error {
 	switch msg := conn.Read().(type) {
 	case *Status:
 		info.ForkID = msg.ForkID
@@ -231,15 +520,94 @@ func readStatus(conn *Conn, info *clientInfo) error {
 		// m.ProtocolVersion
 		info.TotalDifficulty = msg.TD
 		// Set correct TD if received TD is higher
-		if msg.TD.Cmp(_status.TD) > 0 {
-			_status.TD = msg.TD
+		statusLock.Lock()
+		if _highestTD == nil || msg.TD.Cmp(_highestTD) > 0 {
+			_highestTD = msg.TD
 		}
-	case *Disconnect:
-		return fmt.Errorf("bad status handshake: %v", msg.Reason.Error())
-	case *Error:
-		return fmt.Errorf("bad status handshake: %v", msg.Error())
+		statusLock.Unlock()
+		if msg.NetworkID != net.NetworkID {
+			return &probeError{Code: errCodeWrongNetwork, Err: fmt.Errorf("bad status handshake: network %d", msg.NetworkID)}
+		}
+	default:
+		return unexpectedMessage("bad status handshake", msg, errCodeStatusTimeout)
+	}
+	return nil
+}
+
+// readHead requests the header of the head announced in the Status message
+// and records its number and timestamp.
+func readHead(conn *Conn, info *clientInfo) error {
+	req := &eth.GetBlockHeadersPacket{
+		Origin: eth.HashOrNumber{Hash: info.HeadHash},
+		Amount: 1,
+	}
+	var err error
+	if conn.negotiatedProtoVersion >= 66 {
+		err = conn.Write(GetBlockHeaders66{RequestId: headRequestID, GetBlockHeadersPacket: req})
+	} else {
+		// The origin only encodes by pointer.
+		err = conn.Write((*GetBlockHeaders)(req))
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		var headers eth.BlockHeadersPacket
+		switch msg := conn.Read().(type) {
+		case *BlockHeaders:
+			headers = eth.BlockHeadersPacket(*msg)
+		case *BlockHeaders66:
+			if msg.RequestId != headRequestID {
+				continue
+			}
+			headers = msg.BlockHeadersPacket
+		case *Ping:
+			if err := conn.Write(Pong{}); err != nil {
+				return err
+			}
+			continue
+		case *Disconnect, *Error:
+			return unexpectedMessage("bad block headers", msg, errCodeStatusTimeout)
+		default:
+			// Peers announce blocks and transactions right after the
+			// handshake, skip them until the response arrives.
+			continue
+		}
+		if len(headers) != 1 || headers[0].Hash() != info.HeadHash {
+			return fmt.Errorf("peer returned %d headers for head %x", len(headers), info.HeadHash)
+		}
+		info.Blockheight = headers[0].Number.String()
+		info.HeadTime = headers[0].Time
+		info.HeadVerified = true
+		return nil
+	}
+}
+
+func readOperaHandshake(conn *Conn, net *network, info *clientInfo) error {
+	switch msg := conn.Read().(type) {
+	case *OperaHandshake:
+		info.NetworkID = msg.NetworkID
+		if msg.NetworkID != net.NetworkID || msg.Genesis != net.Genesis {
+			return &probeError{Code: errCodeWrongNetwork, Err: fmt.Errorf("bad opera handshake: network %d genesis %x", msg.NetworkID, msg.Genesis)}
+		}
+		if uint(msg.ProtocolVersion) != conn.operaProtoVersion {
+			return &probeError{Code: errCodeProtocolMismatch, Err: fmt.Errorf("bad opera handshake: protocol version %d", msg.ProtocolVersion)}
+		}
+	default:
+		return unexpectedMessage("bad opera handshake", msg, errCodeStatusTimeout)
+	}
+	return nil
+}
+
+func readOperaProgress(conn *Conn, info *clientInfo) error {
+	switch msg := conn.Read().(type) {
+	case *OperaProgress:
+		info.Epoch = msg.Epoch
+		info.Blockheight = strconv.FormatUint(msg.LastBlockIdx, 10)
+		info.HeadHash = msg.LastBlockAtropos
 	default:
-		return fmt.Errorf("bad status handshake: %v", msg.Code())
+		return unexpectedMessage("bad opera progress", msg, errCodeStatusTimeout)
 	}
 	return nil
 }
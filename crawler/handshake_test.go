@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/rlpx"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// newTestConns returns both ends of an RLPx connection which negotiated the
+// given eth version.
+func newTestConns(t *testing.T, ethVersion uint) (*Conn, *Conn) {
+	t.Helper()
+	ourKey, _ := crypto.GenerateKey()
+	peerKey, _ := crypto.GenerateKey()
+	fd1, fd2 := net.Pipe()
+	ours := &Conn{Conn: rlpx.NewConn(fd1, &peerKey.PublicKey), negotiatedProtoVersion: ethVersion}
+	peer := &Conn{Conn: rlpx.NewConn(fd2, nil), negotiatedProtoVersion: ethVersion}
+	t.Cleanup(func() {
+		ours.Close()
+		peer.Close()
+	})
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := peer.Handshake(peerKey)
+		errc <- err
+	}()
+	if _, err := ours.Handshake(ourKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return ours, peer
+}
+
+// startTestPeer accepts a single probe on a local port. It answers our Hello
+// with the given capabilities and hands the connection to serve.
+func startTestPeer(t *testing.T, caps []p2p.Cap, serve func(*Conn)) *enode.Node {
+	t.Helper()
+	key, _ := crypto.GenerateKey()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		ln.Close()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		fd, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		peer := &Conn{Conn: rlpx.NewConn(fd, nil), ourHighestProtoVersion: 68, ourHighestOperaVersion: 63}
+		defer peer.Close()
+		peer.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := peer.Handshake(key); err != nil {
+			return
+		}
+		hello, ok := peer.Read().(*Hello)
+		if !ok {
+			return
+		}
+		pub := crypto.FromECDSAPub(&key.PublicKey)[1:]
+		if err := peer.Write(&Hello{Version: 5, Name: "Geth/v1.10.12-stable/linux-amd64/go1.17", Caps: caps, ID: pub}); err != nil {
+			return
+		}
+		peer.SetSnappy(true)
+		peer.negotiateEthProtocol(hello.Caps)
+		peer.negotiateOperaProtocol(hello.Caps)
+		serve(peer)
+	}()
+	return enode.NewV4(&key.PublicKey, []byte{127, 0, 0, 1}, ln.Addr().(*net.TCPAddr).Port, 0)
+}
+
+// TestProbeWithoutEthGenesis probes an eth peer without knowing the eth
+// genesis, so we send no Status but record the one of the peer.
+func TestProbeWithoutEthGenesis(t *testing.T) {
+	statusLock.Lock()
+	oldStatus, oldTD := _status, _highestTD
+	_status, _highestTD = nil, nil
+	statusLock.Unlock()
+	t.Cleanup(func() {
+		statusLock.Lock()
+		_status, _highestTD = oldStatus, oldTD
+		statusLock.Unlock()
+	})
+
+	network := &network{NetworkID: 250, Config: params.MainnetChainConfig}
+	if ethGenesis(network, "") != (common.Hash{}) {
+		t.Fatal("eth genesis known")
+	}
+	head := &types.Header{Number: big.NewInt(1000), Time: 1650000000, Difficulty: big.NewInt(1)}
+	td := big.NewInt(123456)
+	n := startTestPeer(t, []p2p.Cap{{Name: "eth", Version: 66}}, func(peer *Conn) {
+		status := &Status{ProtocolVersion: 66, NetworkID: 250, TD: td, Head: head.Hash()}
+		if err := peer.Write(status); err != nil {
+			return
+		}
+		for {
+			switch peer.Read().(type) {
+			case *GetBlockHeaders66:
+				peer.Write(BlockHeaders66{RequestId: headRequestID, BlockHeadersPacket: []*types.Header{head}})
+			case *Error:
+				return
+			}
+		}
+	})
+
+	timeouts := probeTimeouts{Dial: time.Second, Hello: time.Second, Status: time.Second}
+	info, err := getClientInfo(network, "", timeouts, n, &probeTimings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.EthVersion != 66 || info.TotalDifficulty.Cmp(td) != 0 || !info.HeadVerified {
+		t.Errorf("got eth/%d, TD %v, head verified %v", info.EthVersion, info.TotalDifficulty, info.HeadVerified)
+	}
+	// Our Status announces the highest TD seen once the genesis is known.
+	status := getStatus(network.Config, 66, common.HexToHash("0x01"), network.NetworkID, "")
+	if status.TD.Cmp(td) != 0 {
+		t.Errorf("got TD %v in our status, want %v", status.TD, td)
+	}
+}
+
+func TestReadHead(t *testing.T) {
+	head := &types.Header{Number: big.NewInt(1000), Time: 1650000000, Difficulty: big.NewInt(1)}
+	other := &types.Header{Number: big.NewInt(999), Time: 1649999999, Difficulty: big.NewInt(1)}
+	headers := func(version uint, id uint64, h ...*types.Header) Message {
+		if version >= 66 {
+			return BlockHeaders66{RequestId: id, BlockHeadersPacket: h}
+		}
+		return BlockHeaders(h)
+	}
+
+	tests := []struct {
+		name     string
+		only66   bool // request IDs exist since eth/66
+		response func(version uint) []Message
+		verified bool
+		code     probeErrorCode
+	}{
+		{
+			name:     "head served",
+			response: func(v uint) []Message { return []Message{headers(v, headRequestID, head)} },
+			verified: true,
+		},
+		{
+			name: "announcements before response",
+			response: func(v uint) []Message {
+				return []Message{
+					NewBlockHashes{{Hash: head.Hash(), Number: 1000}},
+					Ping{},
+					headers(v, headRequestID, head),
+				}
+			},
+			verified: true,
+		},
+		{
+			name:   "response to another request",
+			only66: true,
+			response: func(v uint) []Message {
+				return []Message{headers(v, headRequestID+1, other), headers(v, headRequestID, head)}
+			},
+			verified: true,
+		},
+		{
+			name:     "head unknown",
+			response: func(v uint) []Message { return []Message{headers(v, headRequestID)} },
+			code:     errCodeUnknown,
+		},
+		{
+			name:     "other header",
+			response: func(v uint) []Message { return []Message{headers(v, headRequestID, other)} },
+			code:     errCodeUnknown,
+		},
+		{
+			name:     "disconnect",
+			response: func(uint) []Message { return []Message{Disconnect{Reason: p2p.DiscTooManyPeers}} },
+			code:     errCodeTooManyPeers,
+		},
+		{
+			name:     "no response",
+			response: func(uint) []Message { return nil },
+			code:     errCodeStatusTimeout,
+		},
+	}
+	for _, version := range []uint{65, 66} {
+		for _, test := range tests {
+			if test.only66 && version < 66 {
+				continue
+			}
+			version, test := version, test
+			ours, peer := newTestConns(t, version)
+			requests := make(chan Message, 1)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				requests <- peer.Read()
+				// Take the pongs.
+				pongs := make(chan struct{})
+				go func() {
+					defer close(pongs)
+					for {
+						if _, ok := peer.Read().(*Error); ok {
+							return
+						}
+					}
+				}()
+				defer func() { <-pongs }()
+				for _, msg := range test.response(version) {
+					if err := peer.Write(msg); err != nil {
+						return
+					}
+				}
+			}()
+
+			ours.SetDeadline(time.Now().Add(500 * time.Millisecond))
+			info := &clientInfo{HeadHash: head.Hash()}
+			err := readHead(ours, info)
+			// Unblock the peer if the request wasn't sent.
+			ours.Close()
+			<-done
+
+			switch req := (<-requests).(type) {
+			case *GetBlockHeaders66:
+				if version < 66 || req.RequestId != headRequestID || req.Origin.Hash != head.Hash() || req.Amount != 1 {
+					t.Errorf("eth/%d %s: wrong request %+v", version, test.name, req)
+				}
+			case *GetBlockHeaders:
+				if version >= 66 || req.Origin.Hash != head.Hash() || req.Amount != 1 {
+					t.Errorf("eth/%d %s: wrong request %+v", version, test.name, req)
+				}
+			default:
+				t.Errorf("eth/%d %s: unexpected request %v", version, test.name, req)
+			}
+			if info.HeadVerified != test.verified {
+				t.Errorf("eth/%d %s: head verified %v, want %v", version, test.name, info.HeadVerified, test.verified)
+			}
+			if test.verified {
+				if err != nil {
+					t.Errorf("eth/%d %s: unexpected error %v", version, test.name, err)
+				}
+				if info.Blockheight != "1000" || info.HeadTime != head.Time {
+					t.Errorf("eth/%d %s: got head %s at %d", version, test.name, info.Blockheight, info.HeadTime)
+				}
+				continue
+			}
+			if err == nil {
+				t.Errorf("eth/%d %s: expected error", version, test.name)
+			} else if code := probeErrorCodeOf(err); code != test.code {
+				t.Errorf("eth/%d %s: got error code %v, want %v (%v)", version, test.name, code, test.code, err)
+			}
+			if info.Blockheight != "" {
+				t.Errorf("eth/%d %s: unverified head %s recorded", version, test.name, info.Blockheight)
+			}
+		}
+	}
+}
+
+// testEthAPI serves the blocks of --nodeURL.
+type testEthAPI struct {
+	blocks map[uint64]*operaBlock
+	calls  int32
+}
+
+func (api *testEthAPI) GetBlockByNumber(number hexutil.Uint64, full bool) *operaBlock {
+	atomic.AddInt32(&api.calls, 1)
+	return api.blocks[uint64(number)]
+}
+
+func TestVerifyOperaHead(t *testing.T) {
+	atropos := common.HexToHash("0x0000a1b2000000000000000000000000000000000000000000000000000000ff")
+	api := &testEthAPI{blocks: map[uint64]*operaBlock{
+		5000: {Hash: atropos, Time: 1650000000},
+	}}
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("eth", api); err != nil {
+		t.Fatal(err)
+	}
+	httpSrv := httptest.NewServer(srv)
+	defer httpSrv.Close()
+	operaBlocks = make(map[uint64]*operaBlock)
+
+	tests := []struct {
+		name     string
+		nodeURL  string
+		number   string
+		hash     common.Hash
+		verified bool
+	}{
+		{name: "matching block", nodeURL: httpSrv.URL, number: "5000", hash: atropos, verified: true},
+		{name: "cached block", nodeURL: httpSrv.URL, number: "5000", hash: atropos, verified: true},
+		{name: "other atropos", nodeURL: httpSrv.URL, number: "5000", hash: common.HexToHash("0x01")},
+		{name: "ahead of nodeURL", nodeURL: httpSrv.URL, number: "5001", hash: atropos},
+		{name: "without nodeURL", number: "5000", hash: atropos},
+		{name: "no progress", nodeURL: httpSrv.URL, hash: atropos},
+	}
+	for _, test := range tests {
+		info := &clientInfo{Blockheight: test.number, HeadHash: test.hash}
+		verifyOperaHead(test.nodeURL, info)
+		if info.HeadVerified != test.verified {
+			t.Errorf("%s: head verified %v, want %v", test.name, info.HeadVerified, test.verified)
+		}
+		if test.verified && info.HeadTime != 1650000000 {
+			t.Errorf("%s: got head time %d", test.name, info.HeadTime)
+		}
+		if !test.verified && info.HeadTime != 0 {
+			t.Errorf("%s: unverified head time %d", test.name, info.HeadTime)
+		}
+	}
+	// The matching block is fetched once, the missing one every time.
+	if calls := atomic.LoadInt32(&api.calls); calls != 2 {
+		t.Errorf("got %d RPC calls, want 2", calls)
+	}
+}
+
+func TestNegotiateProtocols(t *testing.T) {
+	tests := []struct {
+		caps        []p2p.Cap
+		eth, opera  uint
+		operaOffset uint64
+	}{
+		{caps: []p2p.Cap{{Name: "eth", Version: 64}}, eth: 64},
+		{caps: []p2p.Cap{{Name: "eth", Version: 65}}, eth: 65},
+		{caps: []p2p.Cap{{Name: "eth", Version: 66}}, eth: 66},
+		{caps: []p2p.Cap{{Name: "eth", Version: 67}}, eth: 67},
+		{caps: []p2p.Cap{{Name: "eth", Version: 68}}, eth: 68},
+		{caps: []p2p.Cap{{Name: "eth", Version: 67}, {Name: "eth", Version: 69}}, eth: 67},
+		{caps: []p2p.Cap{{Name: "eth", Version: 66}, {Name: "opera", Version: 62}}, eth: 66, opera: 62, operaOffset: 33},
+		{caps: []p2p.Cap{{Name: "opera", Version: 62}, {Name: "opera", Version: 63}}, opera: 63, operaOffset: 16},
+	}
+	hashes := []common.Hash{common.HexToHash("0x01"), common.HexToHash("0x02")}
+	for _, test := range tests {
+		ours, peer := newTestConns(t, 0)
+		test := test
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if _, ok := peer.Read().(*Hello); !ok {
+				return
+			}
+			if err := peer.Write(&Hello{Version: 5, Name: "go-opera/v1.1.1-rc.2/linux-amd64/go1.17", Caps: test.caps}); err != nil {
+				return
+			}
+			peer.SetSnappy(true)
+			// Transactions are announced right after the handshake.
+			if test.eth == 68 {
+				peer.Write(NewPooledTransactionHashes68{Types: []byte{0, 2}, Sizes: []uint32{100, 200}, Hashes: hashes})
+			} else if test.eth > 0 {
+				peer.Write(NewPooledTransactionHashes(hashes))
+			}
+		}()
+
+		key, _ := crypto.GenerateKey()
+		var info clientInfo
+		if err := writeHello(ours, key); err != nil {
+			t.Fatal(err)
+		}
+		if err := readHello(ours, &info); err != nil {
+			t.Fatal(err)
+		}
+		if info.EthVersion != test.eth || info.OperaVersion != test.opera {
+			t.Errorf("%v: negotiated eth/%d and opera/%d, want eth/%d and opera/%d", test.caps, info.EthVersion, info.OperaVersion, test.eth, test.opera)
+		}
+		if test.opera > 0 && ours.operaOffset != test.operaOffset {
+			t.Errorf("%v: opera offset %d, want %d", test.caps, ours.operaOffset, test.operaOffset)
+		}
+		if test.eth > 0 {
+			switch msg := ours.Read().(type) {
+			case *NewPooledTransactionHashes68:
+				if test.eth != 68 || !reflect.DeepEqual(msg.Hashes, hashes) || !bytes.Equal(msg.Types, []byte{0, 2}) || !reflect.DeepEqual(msg.Sizes, []uint32{100, 200}) {
+					t.Errorf("%v: got announcement %+v", test.caps, msg)
+				}
+			case *NewPooledTransactionHashes:
+				if test.eth == 68 || !reflect.DeepEqual([]common.Hash(*msg), hashes) {
+					t.Errorf("%v: got announcement %+v", test.caps, msg)
+				}
+			default:
+				t.Errorf("%v: got message %v", test.caps, msg)
+			}
+		}
+		ours.Close()
+		<-done
+	}
+}
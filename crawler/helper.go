@@ -11,44 +11,35 @@ import (
 	"gopkg.in/urfave/cli.v1"
 )
 
-var MainnetBootnodes = []string{
-	"enode://03c70d4597d731ef182678b7664f2a4a3add07056f23d4e01aba86f066080d18fa13abbd2e13e9d4ea762a2715a983b5ac6151162d05ee0434f1847da1a626e9@34.242.220.16:5050",
-	"enode://01c64d1a9dd8a65c56f2d4e373795eb6efd27b714b2b5999363a42a0edc39d7417a431416ceb5c67b1a170983af109e8a15d0c2d44a2ac41ecfb5c23c1a1a48a@3.35.200.210:5050",
-	"enode://7044c88daa5df059e2f7a2667471a8149a5cf66e68643dcb86f399d48c4ff6475b73ee91486ea830d225f7f78a2fdf955208673da51c6852230c3a90a3701c06@3.1.103.70:5050",
-	"enode://594d26c2338566daca9391d73f1b1821bb0b454e6f3d48715116bf42f320924d569534c143b640feec8a8eaa137a0b822426fb62b52a90162270ea5868bdc37c@18.138.254.181:5050",
-	"enode://339e331912e5239a9e13eb82b47be58ea4d3946e91caa2992103a8d4f0226c1e86f9134822d5b238f25c9cbdd473f806caa8e4f8ef1748a6c66395f4bf0dd569@54.66.206.151:5050",
-}
-
-
-func makeDiscoveryConfig(ctx *cli.Context, db *enode.DB) (*enode.LocalNode, discover.Config) {
+func makeDiscoveryConfig(ctx *cli.Context, db *enode.DB, net *network) (*enode.LocalNode, discover.Config, error) {
 	var cfg discover.Config
 	var err error
 
 	if ctx.IsSet(nodekeyFlag.Name) {
 		key, err := crypto.HexToECDSA(ctx.String(nodekeyFlag.Name))
 		if err != nil {
-			panic(fmt.Errorf("-%s: %v", nodekeyFlag.Name, err))
+			return nil, cfg, fmt.Errorf("-%s: %v", nodekeyFlag.Name, err)
 		}
 		cfg.PrivateKey = key
 	} else {
 		cfg.PrivateKey, _ = crypto.GenerateKey()
 	}
 
-	cfg.Bootnodes, err = parseBootnodes(ctx)
+	cfg.Bootnodes, err = parseBootnodes(ctx, net.Bootnodes)
 	if err != nil {
-		panic(err)
+		return nil, cfg, err
 	}
 
-	return enode.NewLocalNode(db, cfg.PrivateKey), cfg
+	return enode.NewLocalNode(db, cfg.PrivateKey), cfg, nil
 }
 
-func listen(ln *enode.LocalNode, addr string) *net.UDPConn {
+func listen(ln *enode.LocalNode, addr string) (*net.UDPConn, error) {
 	if addr == "" {
 		addr = "0.0.0.0:0"
 	}
 	socket, err := net.ListenPacket("udp4", addr)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	usocket := socket.(*net.UDPConn)
 	uaddr := socket.LocalAddr().(*net.UDPAddr)
@@ -58,11 +49,11 @@ func listen(ln *enode.LocalNode, addr string) *net.UDPConn {
 		ln.SetFallbackIP(uaddr.IP)
 	}
 	ln.SetFallbackUDP(uaddr.Port)
-	return usocket
+	return usocket, nil
 }
 
-func parseBootnodes(ctx *cli.Context) ([]*enode.Node, error) {
-	s := MainnetBootnodes
+func parseBootnodes(ctx *cli.Context, bootnodes []string) ([]*enode.Node, error) {
+	s := bootnodes
 	if ctx.IsSet(bootnodesFlag.Name) {
 		input := ctx.String(bootnodesFlag.Name)
 		if input == "" {
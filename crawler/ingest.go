@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/oschwald/geoip2-golang"
+)
+
+const (
+	ingestBatchSize = 500
+	ingestRetries   = 3
+)
+
+// ingestNode is the JSON format of the API's ingestion endpoint.
+type ingestNode struct {
+	ID              string   `json:"id"`
+	Now             int64    `json:"now"`
+	ClientType      string   `json:"clientType"`
+	ClientVersion   string   `json:"clientVersion"`
+	ClientDesc      string   `json:"clientDesc"`
+	OsType          string   `json:"osType"`
+	GoVersion       string   `json:"goVersion"`
+	SoftwareVersion uint64   `json:"softwareVersion"`
+	Capabilities    string   `json:"capabilities"`
+	NetworkID       uint64   `json:"networkId"`
+	Country         string   `json:"country"`
+	ForkHash        string   `json:"forkHash"`
+	ForkNext        uint64   `json:"forkNext"`
+	ErrorReason     int      `json:"errorReason"`
+	ErrorString     string   `json:"errorString"`
+	CrawlerID       string   `json:"crawlerId"`
+	Reachable       bool     `json:"reachable"`
+	Latency         int64    `json:"latency"` // milliseconds
+	Name            string   `json:"name"`
+	ENR             string   `json:"enr"`
+	Seq             uint64   `json:"seq"`
+	PublicKey       string   `json:"publicKey"`
+	IP              string   `json:"ip"`
+	TCP             int      `json:"tcp"`
+	UDP             int      `json:"udp"`
+	City            string   `json:"city"`
+	Latitude        *float64 `json:"latitude"`
+	Longitude       *float64 `json:"longitude"`
+	FirstSeen       int64    `json:"firstSeen"` // unix timestamp, 0 if never reached
+	LastSeen        int64    `json:"lastSeen"`
+	Score           int      `json:"score"`
+	// DisconnectReason is the p2p disconnect reason, nil if the node
+	// didn't disconnect.
+	DisconnectReason *uint `json:"disconnectReason"`
+	// HeadNumber and HeadTime describe the head block of the node, 0 if
+	// unknown. HeadVerified tells whether the head was verified.
+	HeadNumber   uint64 `json:"headNumber"`
+	HeadTime     uint64 `json:"headTime"`
+	HeadVerified bool   `json:"headVerified"`
+	// EthVersion and OperaVersion are the negotiated protocol versions,
+	// 0 if none.
+	EthVersion   uint `json:"ethVersion"`
+	OperaVersion uint `json:"operaVersion"`
+	// Durations of the probe stages in milliseconds, nil if a stage
+	// wasn't reached.
+	ConnectTime   *float64 `json:"connectTime"`
+	HandshakeTime *float64 `json:"handshakeTime"`
+	HelloRTT      *float64 `json:"helloRtt"`
+	StatusRTT     *float64 `json:"statusRtt"`
+	PingRTT       *float64 `json:"pingRtt"`
+	LastProbe     int64    `json:"lastProbe"`
+}
+
+// apiClient pushes crawl results to the ingestion endpoint of the API.
+type apiClient struct {
+	url       string
+	token     string
+	crawlerID string
+	http      *http.Client
+}
+
+func newAPIClient(url, token, crawlerID string) *apiClient {
+	return &apiClient{
+		url:       strings.TrimSuffix(url, "/") + "/v1/ingest",
+		token:     token,
+		crawlerID: crawlerID,
+		http:      &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// postNodes sends the nodes to the API in batches.
+func (c *apiClient) postNodes(geoipDB *geoip2.Reader, nodes []nodeJSON) error {
+	now := time.Now().Unix()
+	batch := make([]ingestNode, 0, ingestBatchSize)
+	for i, n := range nodes {
+		r, err := makeNodeRecord(geoipDB, n)
+		if err != nil {
+			return err
+		}
+		caps := make([]string, len(r.Info.Capabilities))
+		for j, c := range r.Info.Capabilities {
+			caps[j] = c.String()
+		}
+		batch = append(batch, ingestNode{
+			ID:               n.N.ID().String(),
+			Now:              now,
+			ClientType:       r.Info.ClientType,
+			ClientVersion:    r.Info.ClientVersion,
+			ClientDesc:       r.Info.ClientDesc,
+			OsType:           r.Info.OsType,
+			GoVersion:        r.Info.GoVersion,
+			SoftwareVersion:  r.Info.SoftwareVersion,
+			Capabilities:     strings.Join(caps, ","),
+			NetworkID:        r.Info.NetworkID,
+			Country:          r.Country,
+			ForkHash:         r.ForkHash,
+			ForkNext:         r.ForkNext,
+			ErrorReason:      n.ErrorReason,
+			ErrorString:      n.ErrorString,
+			CrawlerID:        c.crawlerID,
+			Reachable:        n.Reachable,
+			Latency:          n.Latency.Milliseconds(),
+			Name:             r.Info.Name,
+			ENR:              r.ENR,
+			Seq:              n.Seq,
+			PublicKey:        r.PK,
+			IP:               n.N.IP().String(),
+			TCP:              n.N.TCP(),
+			UDP:              n.N.UDP(),
+			City:             r.City,
+			Latitude:         r.Latitude,
+			Longitude:        r.Longitude,
+			FirstSeen:        unixSeconds(n.FirstResponse),
+			LastSeen:         unixSeconds(n.LastResponse),
+			Score:            n.Score,
+			DisconnectReason: (*uint)(n.DisconnectReason),
+			HeadNumber:       r.HeadNumber,
+			HeadTime:         r.Info.HeadTime,
+			HeadVerified:     r.Info.HeadVerified,
+			EthVersion:       r.Info.EthVersion,
+			OperaVersion:     r.Info.OperaVersion,
+			ConnectTime:      milliseconds(n.Timings.Connect),
+			HandshakeTime:    milliseconds(n.Timings.Handshake),
+			HelloRTT:         milliseconds(n.Timings.Hello),
+			StatusRTT:        milliseconds(n.Timings.Status),
+			PingRTT:          milliseconds(n.Timings.Ping),
+			LastProbe:        unixSeconds(n.LastProbe),
+		})
+		if len(batch) == ingestBatchSize || i == len(nodes)-1 {
+			if err := c.postBatch(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	log.Info("Pushed nodes to API", "nodes", len(nodes))
+	return nil
+}
+
+// unixSeconds returns t as unix timestamp, or 0 for the zero time.
+func unixSeconds(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// postBatch posts a single batch, retrying with backoff on failure.
+func (c *apiClient) postBatch(batch []ingestNode) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err = c.post(body)
+		if err == nil || attempt == ingestRetries {
+			return err
+		}
+		log.Warn("Pushing nodes to API failed, retrying", "attempt", attempt, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (c *apiClient) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ingestion failed: %v", resp.Status)
+	}
+	return nil
+}
@@ -47,6 +47,7 @@ func init() {
 	// Add subcommands.
 	app.Commands = []cli.Command{
 		crawlerCommand,
+		topologyCommand,
 	}
 }
 
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var (
+	roundDurationTimer = metrics.NewRegisteredTimer("crawler/round/duration", nil)
+	discoveredV4Gauge  = metrics.NewRegisteredGauge("crawler/discovered/v4", nil)
+	discoveredV5Gauge  = metrics.NewRegisteredGauge("crawler/discovered/v5", nil)
+	dialSuccessCounter = metrics.NewRegisteredCounter("crawler/dial/success", nil)
+	queueDepthGauge    = metrics.NewRegisteredGauge("crawler/queue/depth", nil)
+	workersGauge       = metrics.NewRegisteredGauge("crawler/workers/total", nil)
+	busyWorkersGauge   = metrics.NewRegisteredGauge("crawler/workers/busy", nil)
+	dbWriteTimer       = metrics.NewRegisteredTimer("crawler/db/write", nil)
+	topologyEdgesGauge = metrics.NewRegisteredGauge("crawler/topology/edges", nil)
+)
+
+// markDialFailure counts a failed probe by the class of its error.
+func markDialFailure(code probeErrorCode) {
+	metrics.GetOrRegisterCounter("crawler/dial/failure/"+code.String(), nil).Inc(1)
+}
+
+// updateCoverage reports the coverage estimate of an exhaustive crawl round.
+func updateCoverage(protocol string, cov coverageEstimate) {
+	metrics.GetOrRegisterGauge("crawler/coverage/"+protocol+"/found", nil).Update(int64(cov.Found))
+	metrics.GetOrRegisterGauge("crawler/coverage/"+protocol+"/estimated", nil).Update(int64(cov.Estimated))
+	metrics.GetOrRegisterGaugeFloat64("crawler/coverage/"+protocol+"/ratio", nil).Update(cov.Coverage())
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// migration upgrades the database schema by one version.
+type migration func(tx *sql.Tx) error
+
+// migrations are applied in order. The schema version of a database is the
+// number of migrations applied to it. Migrations must be idempotent, as
+// databases created before versioning start at version zero.
+var migrations = []migration{
+	createNodesTable,
+	addEpochColumn,
+	createHistoryTables,
+	normalizeNodesTable,
+	addRowVersionColumn,
+	addVantageColumns,
+	addRecordColumns,
+	addDisconnectReasonColumn,
+	addHeadTimeColumn,
+	addProtocolVersionColumns,
+	addTimingColumns,
+	createEdgesTable,
+	addProbeScheduleColumns,
+	clearZeroForkIDs,
+	addHeadVerifiedColumn,
+}
+
+// migrateDB brings the database schema up to date.
+func migrateDB(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version number not null)`); err != nil {
+		return err
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, len(migrations))
+	}
+	for ; version < len(migrations); version++ {
+		log.Info("Migrating database", "from", version, "to", version+1)
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := migrations[version](tx); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("migration to version %d failed: %v", version+1, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM schema_version`); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_version(version) values(?)`, version+1); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+// hasColumn reports whether a table has the given column.
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query(fmt.Sprintf(`SELECT name FROM pragma_table_info('%s')`, table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// addColumn adds a column to a table unless it already exists.
+func addColumn(tx *sql.Tx, table, column, typ string) error {
+	exists, err := hasColumn(tx, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, typ))
+	return err
+}
+
+func createNodesTable(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS nodes (
+		ID text not null, 
+		Now text not null,
+		ClientType text,
+		ClientDesc text,
+		ClientVersion text,
+		OsType text,
+		GoVersion text,
+		PK text,
+		SoftwareVersion text,
+		Capabilities text,
+		NetworkID number,
+		ForkID text,
+		Blockheight text,
+		TotalDifficulty text,
+		HeadHash text,
+		IP text,
+		Country text,
+		City text,
+		Coordinates text,
+		FirstSeen text,
+		LastSeen text,
+		Seq number,
+		Score number,
+		ConnType text,
+		ErrorReason number,
+		ErrorString text,
+		PRIMARY KEY (ID)
+	);
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+func addEpochColumn(tx *sql.Tx) error {
+	return addColumn(tx, "nodes", "Epoch", "number")
+}
+
+func createHistoryTables(tx *sql.Tx) error {
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS rounds (
+		ID integer PRIMARY KEY AUTOINCREMENT,
+		Started number not null,
+		Finished number not null,
+		Nodes number
+	);
+	CREATE TABLE IF NOT EXISTS observations (
+		RoundID number not null,
+		NodeID text not null,
+		Timestamp number not null,
+		ClientType text,
+		ClientDesc text,
+		ClientVersion text,
+		OsType text,
+		GoVersion text,
+		NetworkID number,
+		Epoch number,
+		Blockheight text,
+		HeadHash text,
+		IP text,
+		Score number,
+		ErrorReason number,
+		ErrorString text
+	);
+	CREATE INDEX IF NOT EXISTS observations_node ON observations(NodeID, Timestamp);
+	CREATE INDEX IF NOT EXISTS observations_time ON observations(Timestamp);
+	`
+	_, err := tx.Exec(sqlStmt)
+	return err
+}
+
+// normalizeNodesTable replaces the string encoded public key, fork ID,
+// coordinates and timestamps of the nodes table with typed columns and moves
+// the capabilities into the node_capabilities table.
+func normalizeNodesTable(tx *sql.Tx) error {
+	// The legacy ForkID column is gone once the table was normalized.
+	if legacy, err := hasColumn(tx, "nodes", "ForkID"); err != nil || !legacy {
+		return err
+	}
+	sqlStmt := `
+	CREATE TABLE nodes_typed (
+		ID text not null,
+		Now number not null,
+		ClientType text,
+		ClientDesc text,
+		ClientVersion text,
+		OsType text,
+		GoVersion text,
+		PK text,
+		SoftwareVersion number,
+		NetworkID number,
+		ForkHash text,
+		ForkNext number,
+		Epoch number,
+		Blockheight text,
+		TotalDifficulty text,
+		HeadHash text,
+		IP text,
+		Country text,
+		City text,
+		Latitude real,
+		Longitude real,
+		FirstSeen number,
+		LastSeen number,
+		Seq number,
+		Score number,
+		ConnType text,
+		ErrorReason number,
+		ErrorString text,
+		PRIMARY KEY (ID)
+	);
+	CREATE TABLE IF NOT EXISTS node_capabilities (
+		NodeID text not null,
+		Name text not null,
+		Version number not null,
+		PRIMARY KEY (NodeID, Name, Version)
+	);
+	CREATE INDEX IF NOT EXISTS node_capabilities_name ON node_capabilities(Name, Version);
+	`
+	if _, err := tx.Exec(sqlStmt); err != nil {
+		return err
+	}
+
+	type legacyNode struct {
+		id, now, pk, caps, forkID, coords, firstSeen, lastSeen string
+	}
+	rows, err := tx.Query(`SELECT ID, Now, IFNULL(PK, ''), IFNULL(Capabilities, ''), IFNULL(ForkID, ''),
+		IFNULL(Coordinates, ''), IFNULL(FirstSeen, ''), IFNULL(LastSeen, '') FROM nodes`)
+	if err != nil {
+		return err
+	}
+	var legacy []legacyNode
+	for rows.Next() {
+		var n legacyNode
+		if err := rows.Scan(&n.id, &n.now, &n.pk, &n.caps, &n.forkID, &n.coords, &n.firstSeen, &n.lastSeen); err != nil {
+			rows.Close()
+			return err
+		}
+		legacy = append(legacy, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO nodes_typed(ID, Now, ClientType, ClientDesc, ClientVersion, OsType, GoVersion,
+		SoftwareVersion, NetworkID, Epoch, Blockheight, TotalDifficulty, HeadHash, IP, Country, City,
+		Seq, Score, ConnType, ErrorReason, ErrorString)
+		SELECT ID, 0, ClientType, ClientDesc, ClientVersion, OsType, GoVersion,
+		SoftwareVersion, NetworkID, Epoch, Blockheight, TotalDifficulty, HeadHash, IP, Country, City,
+		Seq, Score, ConnType, ErrorReason, ErrorString FROM nodes`)
+	if err != nil {
+		return err
+	}
+	update, err := tx.Prepare(`UPDATE nodes_typed SET Now = ?, PK = ?, ForkHash = ?, ForkNext = ?,
+		Latitude = ?, Longitude = ?, FirstSeen = ?, LastSeen = ? WHERE ID = ?`)
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+	insertCap, err := tx.Prepare(`INSERT OR IGNORE INTO node_capabilities(NodeID, Name, Version) values(?,?,?)`)
+	if err != nil {
+		return err
+	}
+	defer insertCap.Close()
+
+	for _, n := range legacy {
+		forkHash, forkNext := parseLegacyForkID(n.forkID)
+		lat, lon := parseLegacyCoordinates(n.coords)
+		_, err := update.Exec(
+			unixTime(parseLegacyTime(n.now)),
+			parseLegacyPubkey(n.pk),
+			forkHash,
+			forkNext,
+			lat,
+			lon,
+			unixTime(parseLegacyTime(n.firstSeen)),
+			unixTime(parseLegacyTime(n.lastSeen)),
+			n.id,
+		)
+		if err != nil {
+			return err
+		}
+		for _, c := range strings.Split(n.caps, ",") {
+			nameVersion := strings.SplitN(strings.TrimSpace(c), "/", 2)
+			if len(nameVersion) != 2 {
+				continue
+			}
+			version, err := strconv.ParseUint(nameVersion[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			if _, err := insertCap.Exec(n.id, nameVersion[0], version); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec(`DROP TABLE nodes; ALTER TABLE nodes_typed RENAME TO nodes;`)
+	return err
+}
+
+// addRowVersionColumn adds the RowVersion change feed cursor to the nodes
+// table. Existing rows are numbered in insertion order.
+func addRowVersionColumn(tx *sql.Tx) error {
+	if err := addColumn(tx, "nodes", "RowVersion", "number"); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`UPDATE nodes SET RowVersion = rowid WHERE RowVersion IS NULL;
+	CREATE INDEX IF NOT EXISTS nodes_row_version ON nodes(RowVersion);`)
+	return err
+}
+
+// addVantageColumns records which crawler instance observed a node, whether
+// it was reachable and the probe latency in milliseconds.
+func addVantageColumns(tx *sql.Tx) error {
+	for _, table := range []string{"nodes", "observations"} {
+		if err := addColumn(tx, table, "CrawlerID", "text"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, table, "Reachable", "number"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, table, "Latency", "number"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addRecordColumns stores the raw client name of the Hello message and the
+// node record with its ports.
+func addRecordColumns(tx *sql.Tx) error {
+	for _, c := range []struct{ name, typ string }{
+		{"Name", "text"},
+		{"ENR", "text"},
+		{"TCP", "number"},
+		{"UDP", "number"},
+	} {
+		if err := addColumn(tx, "nodes", c.name, c.typ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addDisconnectReasonColumn stores the p2p disconnect reason sent by a node
+// during a probe, NULL if it didn't disconnect.
+func addDisconnectReasonColumn(tx *sql.Tx) error {
+	for _, table := range []string{"nodes", "observations"} {
+		if err := addColumn(tx, table, "DisconnectReason", "number"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addHeadTimeColumn stores the timestamp of the head block served by a node.
+func addHeadTimeColumn(tx *sql.Tx) error {
+	for _, table := range []string{"nodes", "observations"} {
+		if err := addColumn(tx, table, "HeadTime", "number"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addProtocolVersionColumns stores the eth and opera protocol versions
+// negotiated with a node, 0 if it shares none with the crawler.
+func addProtocolVersionColumns(tx *sql.Tx) error {
+	for _, table := range []string{"nodes", "observations"} {
+		if err := addColumn(tx, table, "EthVersion", "number"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, table, "OperaVersion", "number"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTimingColumns stores the durations of the probe stages in
+// milliseconds, NULL if a stage wasn't reached.
+func addTimingColumns(tx *sql.Tx) error {
+	for _, table := range []string{"nodes", "observations"} {
+		for _, column := range []string{"ConnectTime", "HandshakeTime", "HelloRTT", "StatusRTT", "PingRTT"} {
+			if err := addColumn(tx, table, column, "number"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// createEdgesTable stores the discovery topology: an edge means that FromID
+// returned ToID from its routing table.
+func createEdgesTable(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS edges (
+		FromID text not null,
+		ToID text not null,
+		Protocol text not null,
+		Distance number,
+		CrawlerID text,
+		FirstSeen number not null,
+		LastSeen number not null,
+		PRIMARY KEY (FromID, ToID, Protocol)
+	);
+	CREATE INDEX IF NOT EXISTS edges_last_seen ON edges(LastSeen);
+	`)
+	return err
+}
+
+// addProbeScheduleColumns stores when a node was last probed over RLPx and
+// when it is due again, so a restarted crawler keeps the schedule.
+func addProbeScheduleColumns(tx *sql.Tx) error {
+	if err := addColumn(tx, "nodes", "LastProbe", "number"); err != nil {
+		return err
+	}
+	return addColumn(tx, "nodes", "NextProbe", "number")
+}
+
+// clearZeroForkIDs replaces the zero fork ID, which was stored for peers
+// that sent none, with NULL.
+func clearZeroForkIDs(tx *sql.Tx) error {
+	_, err := tx.Exec(`UPDATE nodes SET ForkHash = NULL, ForkNext = NULL
+		WHERE ForkHash = '0x00000000' AND IFNULL(ForkNext, 0) = 0`)
+	return err
+}
+
+// parseLegacyTime parses a timestamp stored with time.Time.String.
+func parseLegacyTime(s string) time.Time {
+	// strip the monotonic clock reading
+	if i := strings.Index(s, " m="); i >= 0 {
+		s = s[:i]
+	}
+	t, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// parseLegacyPubkey converts a "X: ..., Y: ..." public key to compressed hex.
+func parseLegacyPubkey(s string) string {
+	var xs, ys string
+	if _, err := fmt.Sscanf(s, "X: %s Y: %s", &xs, &ys); err != nil {
+		return ""
+	}
+	x, okx := new(big.Int).SetString(strings.TrimSuffix(xs, ","), 10)
+	y, oky := new(big.Int).SetString(ys, 10)
+	if !okx || !oky || x.BitLen() > 256 || y.BitLen() > 256 {
+		return ""
+	}
+	pub := make([]byte, 65)
+	pub[0] = 4 // uncompressed point
+	x.FillBytes(pub[1:33])
+	y.FillBytes(pub[33:])
+	key, err := crypto.UnmarshalPubkey(pub)
+	if err != nil {
+		return ""
+	}
+	return hexutil.Encode(crypto.CompressPubkey(key))
+}
+
+// parseLegacyForkID splits a "Hash: ..., Next ..." fork ID. The hash of eth
+// fork IDs was formatted as a byte array, e.g. "[252 100 236 4]". The zero
+// fork ID of peers which sent none is returned as NULL.
+func parseLegacyForkID(s string) (interface{}, interface{}) {
+	parts := strings.SplitN(strings.TrimPrefix(s, "Hash: "), ", Next ", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	hash := parts[0]
+	if strings.HasPrefix(hash, "[") {
+		var b []byte
+		for _, f := range strings.Fields(strings.Trim(hash, "[]")) {
+			v, err := strconv.ParseUint(f, 10, 8)
+			if err != nil {
+				return nil, nil
+			}
+			b = append(b, byte(v))
+		}
+		hash = hexutil.Encode(b)
+	}
+	next, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return hash, nil
+	}
+	if hash == "0x00000000" && next == 0 {
+		return nil, nil
+	}
+	return hash, next
+}
+
+// parseLegacyCoordinates splits "lat,lon" coordinates.
+func parseLegacyCoordinates(s string) (interface{}, interface{}) {
+	parts := strings.SplitN(s, ",", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	lat, err1 := strconv.ParseFloat(parts[0], 64)
+	lon, err2 := strconv.ParseFloat(parts[1], 64)
+	if err1 != nil || err2 != nil {
+		return nil, nil
+	}
+	return lat, lon
+}
+
+// addHeadVerifiedColumn tells whether the head of a node was verified, by the
+// node serving the head block or by matching the block of --nodeURL.
+func addHeadVerifiedColumn(tx *sql.Tx) error {
+	for _, table := range []string{"nodes", "observations"} {
+		if err := addColumn(tx, table, "HeadVerified", "number"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
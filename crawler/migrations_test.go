@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: opens a new database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// legacySchema is the nodes table created by crawlers before the schema was
+// versioned.
+const legacySchema = `
+	CREATE TABLE nodes (
+		ID text not null,
+		Now text not null,
+		ClientType text,
+		ClientDesc text,
+		ClientVersion text,
+		OsType text,
+        GoVersion text,
+		PK text,
+		SoftwareVersion text,
+		Capabilities text,
+		NetworkID number,
+		ForkID text,
+		Blockheight text,
+		TotalDifficulty text,
+		HeadHash text,
+		IP text,
+		Country text,
+		City text,
+		Coordinates text,
+		FirstSeen text,
+		LastSeen text,
+		Seq number,
+		Score number,
+		ConnType text,
+		ErrorReason number,
+		ErrorString text,
+		PRIMARY KEY (ID)
+	);`
+
+func checkSchemaVersion(t *testing.T, db *sql.DB) {
+	t.Helper()
+	version, err := schemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Fatalf("wrong schema version: got %d, want %d", version, len(migrations))
+	}
+}
+
+func TestMigrateDB(t *testing.T) {
+	db := openTestDB(t)
+	for i := 0; i < 2; i++ {
+		if err := migrateDB(db); err != nil {
+			t.Fatalf("migration %d failed: %v", i, err)
+		}
+		checkSchemaVersion(t, db)
+	}
+}
+
+// Databases created before versioning start at version zero, so every
+// migration must also apply to an up to date schema.
+func TestMigrationsIdempotent(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE schema_version SET version = 0`); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	checkSchemaVersion(t, db)
+}
+
+func TestMigrateNewerDB(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE schema_version SET version = ?`, len(migrations)+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDB(db); err == nil {
+		t.Fatal("expected error for newer schema version")
+	}
+}
+
+func TestMigrateLegacyDB(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.Exec(legacySchema); err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A row as written by the legacy updateNodes.
+	_, err = db.Exec(`INSERT INTO nodes(ID, Now, ClientType, ClientVersion, PK, SoftwareVersion, Capabilities,
+		NetworkID, ForkID, Blockheight, TotalDifficulty, HeadHash, IP, Country, City, Coordinates,
+		FirstSeen, LastSeen, Seq, Score, ConnType, ErrorReason, ErrorString)
+		values(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		"a1",
+		"2022-03-01 10:00:00.123456789 +0000 UTC m=+12.500000001",
+		"go-opera",
+		"v1.1.0-rc.4",
+		fmt.Sprintf("X: %v, Y: %v", key.PublicKey.X, key.PublicKey.Y),
+		"5",
+		", opera/62, opera/63",
+		250,
+		"Hash: [252 100 236 4], Next 1150000",
+		"",
+		"<nil>",
+		"0x0000000000000000000000000000000000000000000000000000000000000000",
+		"1.2.3.4",
+		"France",
+		"Paris",
+		"48.8582,2.2945",
+		"2022-02-01 09:00:00 +0000 UTC",
+		"0001-01-01 00:00:00 +0000 UTC",
+		7,
+		11,
+		"TCP",
+		-1,
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	checkSchemaVersion(t, db)
+
+	var (
+		clientType, pk, forkHash string
+		now, firstSeen           int64
+		forkNext                 uint64
+		lat, lon                 float64
+		lastSeen                 sql.NullInt64
+		score                    int
+	)
+	err = db.QueryRow(`SELECT ClientType, Now, PK, ForkHash, ForkNext, Latitude, Longitude, FirstSeen, LastSeen, Score
+		FROM nodes WHERE ID = 'a1'`).Scan(&clientType, &now, &pk, &forkHash, &forkNext, &lat, &lon, &firstSeen, &lastSeen, &score)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientType != "go-opera" || score != 11 {
+		t.Errorf("data lost during migration: client %q score %d", clientType, score)
+	}
+	if want := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC).Unix(); now != want {
+		t.Errorf("wrong Now: got %d, want %d", now, want)
+	}
+	if want := hexutil.Encode(crypto.CompressPubkey(&key.PublicKey)); pk != want {
+		t.Errorf("wrong PK: got %s, want %s", pk, want)
+	}
+	if forkHash != "0xfc64ec04" || forkNext != 1150000 {
+		t.Errorf("wrong fork ID: got %s %d", forkHash, forkNext)
+	}
+	if lat != 48.8582 || lon != 2.2945 {
+		t.Errorf("wrong coordinates: got %v,%v", lat, lon)
+	}
+	if want := time.Date(2022, 2, 1, 9, 0, 0, 0, time.UTC).Unix(); firstSeen != want {
+		t.Errorf("wrong FirstSeen: got %d, want %d", firstSeen, want)
+	}
+	if lastSeen.Valid {
+		t.Errorf("zero LastSeen stored as %d", lastSeen.Int64)
+	}
+
+	var caps int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM node_capabilities WHERE NodeID = 'a1' AND Name = 'opera'`).Scan(&caps); err != nil {
+		t.Fatal(err)
+	}
+	if caps != 2 {
+		t.Errorf("got %d capabilities, want 2", caps)
+	}
+
+	// The upgraded database must take the rows of the current crawler.
+	n := newTestNode(t)
+	node := nodeJSON{N: n, Seq: n.Seq(), Score: 1, Info: &clientInfo{ClientType: "go-opera", Epoch: 5}, LastCheck: time.Now()}
+	if err := updateNodes(db, nil, "test", time.Now().Add(-time.Minute), []nodeJSON{node}); err != nil {
+		t.Fatalf("cannot write to upgraded database: %v", err)
+	}
+}
+
+func TestParseLegacyTime(t *testing.T) {
+	cet := time.FixedZone("CET", 3600)
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"2022-03-01 10:00:00.123456789 +0000 UTC m=+12.500000001", time.Date(2022, 3, 1, 10, 0, 0, 123456789, time.UTC)},
+		{"2022-03-01 10:00:00 +0000 UTC", time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)},
+		{"2022-03-01 11:00:00.5 +0100 CET", time.Date(2022, 3, 1, 11, 0, 0, 500000000, cet)},
+		{"0001-01-01 00:00:00 +0000 UTC", time.Time{}},
+		{"", time.Time{}},
+		{"2022-03-01T10:00:00Z", time.Time{}},
+	}
+	for _, test := range tests {
+		if got := parseLegacyTime(test.in); !got.Equal(test.want) {
+			t.Errorf("parseLegacyTime(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseLegacyPubkey(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := key.PublicKey.X, key.PublicKey.Y
+	tests := []struct {
+		in, want string
+	}{
+		{fmt.Sprintf("X: %v, Y: %v", x, y), hexutil.Encode(crypto.CompressPubkey(&key.PublicKey))},
+		{fmt.Sprintf("X: %v, Y: %v", x, new(big.Int).Add(y, big.NewInt(1))), ""}, // not on the curve
+		{"X: 1, Y: abc", ""},
+		{"X: " + strings.Repeat("9", 80) + ", Y: 1", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := parseLegacyPubkey(test.in); got != test.want {
+			t.Errorf("parseLegacyPubkey(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseLegacyForkID(t *testing.T) {
+	tests := []struct {
+		in         string
+		hash, next interface{}
+	}{
+		// eth fork ID, the hash formatted as byte array
+		{"Hash: [252 100 236 4], Next 1150000", "0xfc64ec04", uint64(1150000)},
+		{"Hash: [252 100 236 4], Next 0", "0xfc64ec04", uint64(0)},
+		// eth2 fork digest and epoch
+		{"Hash: 0xb5303f2a, Next 18446744073709551615", "0xb5303f2a", uint64(18446744073709551615)},
+		// peers which sent no fork ID
+		{"Hash: [0 0 0 0], Next 0", nil, nil},
+		{"Hash: [252 100 236 4], Next x", "0xfc64ec04", nil},
+		{"Hash: [252 1000 236 4], Next 0", nil, nil},
+		{"", nil, nil},
+	}
+	for _, test := range tests {
+		hash, next := parseLegacyForkID(test.in)
+		if hash != test.hash || next != test.next {
+			t.Errorf("parseLegacyForkID(%q) = %v, %v, want %v, %v", test.in, hash, next, test.hash, test.next)
+		}
+	}
+}
+
+func TestParseLegacyCoordinates(t *testing.T) {
+	tests := []struct {
+		in       string
+		lat, lon interface{}
+	}{
+		{"48.8582,2.2945", 48.8582, 2.2945},
+		{"-33.8688,151.2093", -33.8688, 151.2093},
+		{"0,0", 0.0, 0.0},
+		{"48.8582", nil, nil},
+		{"abc,2.2945", nil, nil},
+		{"", nil, nil},
+	}
+	for _, test := range tests {
+		lat, lon := parseLegacyCoordinates(test.in)
+		if lat != test.lat || lon != test.lon {
+			t.Errorf("parseLegacyCoordinates(%q) = %v, %v, want %v, %v", test.in, lat, lon, test.lat, test.lon)
+		}
+	}
+}
+
+func TestClearZeroForkIDs(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Exec(`INSERT INTO nodes(ID, Now, ForkHash, ForkNext) values('zero', 0, '0x00000000', 0), ('eth', 0, '0xfc64ec04', 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clearZeroForkIDs(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	var zero, eth sql.NullString
+	if err := db.QueryRow(`SELECT ForkHash FROM nodes WHERE ID = 'zero'`).Scan(&zero); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT ForkHash FROM nodes WHERE ID = 'eth'`).Scan(&eth); err != nil {
+		t.Fatal(err)
+	}
+	if zero.Valid || eth.String != "0xfc64ec04" {
+		t.Errorf("got fork hashes %v and %v, want NULL and 0xfc64ec04", zero, eth)
+	}
+}
+
+func TestUpdateNodesWithoutForkID(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	n := newTestNode(t)
+	node := nodeJSON{N: n, Score: 1, Info: &clientInfo{ClientType: "go-opera"}, LastCheck: time.Now()}
+	if err := updateNodes(db, nil, "test", time.Now().Add(-time.Minute), []nodeJSON{node}); err != nil {
+		t.Fatal(err)
+	}
+	var hash sql.NullString
+	var next sql.NullInt64
+	if err := db.QueryRow(`SELECT ForkHash, ForkNext FROM nodes`).Scan(&hash, &next); err != nil {
+		t.Fatal(err)
+	}
+	if hash.Valid || next.Valid {
+		t.Errorf("zero fork ID stored as %v, %v", hash.String, next.Int64)
+	}
+}
+
+func TestUpdateNodesDiscoveryObservation(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		started = time.Now().Add(-time.Minute)
+		info    = &clientInfo{ClientType: "go-opera"}
+		stale   = nodeJSON{N: newTestNode(t), Score: 3, Info: info, Reachable: true, Latency: 50 * time.Millisecond,
+			LastCheck: time.Now(), LastProbe: started.Add(-time.Hour)}
+		probed = nodeJSON{N: newTestNode(t), Score: 5, Info: info, Reachable: true, Latency: 50 * time.Millisecond,
+			LastCheck: time.Now(), LastProbe: time.Now()}
+	)
+	if err := updateNodes(db, nil, "test", started, []nodeJSON{stale, probed}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		node   nodeJSON
+		probed bool
+	}{{stale, false}, {probed, true}} {
+		var (
+			score     int
+			client    sql.NullString
+			reachable sql.NullBool
+			latency   sql.NullInt64
+		)
+		err := db.QueryRow(`SELECT Score, ClientType, Reachable, Latency FROM observations WHERE NodeID = ?`,
+			test.node.N.ID().String()).Scan(&score, &client, &reachable, &latency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if score != test.node.Score {
+			t.Errorf("got score %d, want %d", score, test.node.Score)
+		}
+		if client.Valid != test.probed || reachable.Valid != test.probed || latency.Valid != test.probed {
+			t.Errorf("probed %v: got client %v, reachable %v, latency %v", test.probed, client, reachable, latency)
+		}
+		if test.probed && (client.String != "go-opera" || !reachable.Bool || latency.Int64 != 50) {
+			t.Errorf("got client %q, reachable %v, latency %d", client.String, reachable.Bool, latency.Int64)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// network is a preset of everything needed to crawl an Opera network: where
+// to bootstrap discovery and what to announce in the protocol handshakes.
+type network struct {
+	Name      string   `json:"name"`
+	NetworkID uint64   `json:"networkId"`
+	Bootnodes []string `json:"bootnodes"`
+	// Genesis is the genesis ID announced in the opera handshake.
+	Genesis common.Hash `json:"genesis"`
+	// EthGenesis is the hash of the genesis block announced in the eth
+	// Status message, which differs from the opera genesis ID. If it is
+	// unset, it is read from the node given with --nodeURL.
+	EthGenesis common.Hash `json:"ethGenesis,omitempty"`
+	// Config holds the fork schedule used to compute the eth fork ID.
+	Config *params.ChainConfig `json:"config"`
+}
+
+var MainnetBootnodes = []string{
+	"enode://03c70d4597d731ef182678b7664f2a4a3add07056f23d4e01aba86f066080d18fa13abbd2e13e9d4ea762a2715a983b5ac6151162d05ee0434f1847da1a626e9@34.242.220.16:5050",
+	"enode://01c64d1a9dd8a65c56f2d4e373795eb6efd27b714b2b5999363a42a0edc39d7417a431416ceb5c67b1a170983af109e8a15d0c2d44a2ac41ecfb5c23c1a1a48a@3.35.200.210:5050",
+	"enode://7044c88daa5df059e2f7a2667471a8149a5cf66e68643dcb86f399d48c4ff6475b73ee91486ea830d225f7f78a2fdf955208673da51c6852230c3a90a3701c06@3.1.103.70:5050",
+	"enode://594d26c2338566daca9391d73f1b1821bb0b454e6f3d48715116bf42f320924d569534c143b640feec8a8eaa137a0b822426fb62b52a90162270ea5868bdc37c@18.138.254.181:5050",
+	"enode://339e331912e5239a9e13eb82b47be58ea4d3946e91caa2992103a8d4f0226c1e86f9134822d5b238f25c9cbdd473f806caa8e4f8ef1748a6c66395f4bf0dd569@54.66.206.151:5050",
+}
+
+var TestnetBootnodes = []string{
+	"enode://563b30428f48357f31c9d4906ca2f3d3815d663b151302c1ba9d58f3428265b554398c6fabf4b806a49525670cd9e031257c805375b9fdbcc015f60a7943e427@3.213.142.230:7946",
+	"enode://8b53fe4410cde82d98d28697d56ccb793f9a67b1f8807c523eadafe96339d6e56bc82c0e702757ac5010972e966761b1abecb4935d9a86a9feed47e3e9ba27a6@3.227.34.226:7946",
+	"enode://1703640d1239434dcaf010541cafeeb3c4c707be9098954c50aa705f6e97e2d0273671df13f6e447563e7d3a7c7ffc88de48318d8a3cc2cc59d196516054f17e@52.72.222.228:7946",
+}
+
+// MainnetNetwork is the Opera mainnet.
+var MainnetNetwork = &network{
+	Name:      "mainnet",
+	NetworkID: 250,
+	Bootnodes: MainnetBootnodes,
+	Genesis:   common.HexToHash("0x4a53c5445584b3bfc20dbfb2ec18ae20037c716f3ba2d9e1da768a9deca17cb4"),
+	Config:    operaChainConfig(250, 37455223, 37534833),
+}
+
+// TestnetNetwork is the Opera testnet.
+var TestnetNetwork = &network{
+	Name:      "testnet",
+	NetworkID: 4002,
+	Bootnodes: TestnetBootnodes,
+	Genesis:   common.HexToHash("0xc4a5fc96e575a16a9a0c7349d44dc4d0f602a54e0a8543360c2fee4c3937b49e"),
+	Config:    operaChainConfig(4002, 1559470, 7513335),
+}
+
+// operaChainConfig returns the EVM fork schedule of an Opera network. All
+// forks up to Istanbul are active from genesis, Berlin and London were
+// enabled by network upgrades.
+func operaChainConfig(chainID uint64, berlin, london int64) *params.ChainConfig {
+	return &params.ChainConfig{
+		ChainID:             new(big.Int).SetUint64(chainID),
+		HomesteadBlock:      big.NewInt(0),
+		EIP150Block:         big.NewInt(0),
+		EIP155Block:         big.NewInt(0),
+		EIP158Block:         big.NewInt(0),
+		ByzantiumBlock:      big.NewInt(0),
+		ConstantinopleBlock: big.NewInt(0),
+		PetersburgBlock:     big.NewInt(0),
+		IstanbulBlock:       big.NewInt(0),
+		BerlinBlock:         big.NewInt(berlin),
+		LondonBlock:         big.NewInt(london),
+	}
+}
+
+// makeNetwork returns the network preset selected on the command line, with
+// the network ID overridden if the flag is set. Bootnodes given on the command
+// line take precedence over the preset in parseBootnodes.
+func makeNetwork(ctx *cli.Context) (*network, error) {
+	var net network
+	switch name := ctx.String(networkFlag.Name); name {
+	case "mainnet":
+		net = *MainnetNetwork
+	case "testnet":
+		net = *TestnetNetwork
+	case "custom":
+		file := ctx.String(networkFileFlag.Name)
+		if file == "" {
+			return nil, fmt.Errorf("--%s is required for the custom network", networkFileFlag.Name)
+		}
+		if err := common.LoadJSON(file, &net); err != nil {
+			return nil, err
+		}
+		if net.Name == "" {
+			net.Name = name
+		}
+		if err := net.validate(); err != nil {
+			return nil, fmt.Errorf("network file %s: %v", file, err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown network %q", name)
+	}
+	if ctx.IsSet(networkIDFlag.Name) {
+		net.NetworkID = ctx.Uint64(networkIDFlag.Name)
+	}
+	return &net, nil
+}
+
+// validate checks that a network loaded from a file can be crawled.
+func (net *network) validate() error {
+	if net.NetworkID == 0 {
+		return fmt.Errorf("missing networkId")
+	}
+	if net.Genesis == (common.Hash{}) {
+		return fmt.Errorf("missing genesis")
+	}
+	if net.Config == nil {
+		return fmt.Errorf("missing fork schedule")
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// newTestContext returns a cli context with the given flags parsed from args.
+func newTestContext(t *testing.T, flags []cli.Flag, args ...string) *cli.Context {
+	t.Helper()
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, f := range flags {
+		f.Apply(set)
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(nil, set, nil)
+}
+
+func TestMakeNetwork(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	valid := writeFile("valid.json", `{
+		"name": "mynet",
+		"networkId": 4003,
+		"bootnodes": ["enode://03c70d4597d731ef182678b7664f2a4a3add07056f23d4e01aba86f066080d18fa13abbd2e13e9d4ea762a2715a983b5ac6151162d05ee0434f1847da1a626e9@127.0.0.1:5050"],
+		"genesis": "0x1111111111111111111111111111111111111111111111111111111111111111",
+		"ethGenesis": "0x2222222222222222222222222222222222222222222222222222222222222222",
+		"config": {"chainId": 4003, "berlinBlock": 0, "londonBlock": 0}
+	}`)
+	unnamed := writeFile("unnamed.json", `{
+		"networkId": 4003,
+		"genesis": "0x1111111111111111111111111111111111111111111111111111111111111111",
+		"config": {"chainId": 4003}
+	}`)
+	noID := writeFile("noid.json", `{
+		"genesis": "0x1111111111111111111111111111111111111111111111111111111111111111",
+		"config": {"chainId": 4003}
+	}`)
+	noGenesis := writeFile("nogenesis.json", `{"networkId": 4003, "config": {"chainId": 4003}}`)
+	noConfig := writeFile("noconfig.json", `{
+		"networkId": 4003,
+		"genesis": "0x1111111111111111111111111111111111111111111111111111111111111111"
+	}`)
+	broken := writeFile("broken.json", `{"networkId": `)
+
+	tests := []struct {
+		args    []string
+		name    string
+		id      uint64
+		genesis common.Hash
+		wantErr bool
+	}{
+		{args: nil, name: "mainnet", id: 250, genesis: MainnetNetwork.Genesis},
+		{args: []string{"--network", "testnet"}, name: "testnet", id: 4002, genesis: TestnetNetwork.Genesis},
+		{args: []string{"--network", "testnet", "--networkid", "7"}, name: "testnet", id: 7, genesis: TestnetNetwork.Genesis},
+		{args: []string{"--network", "custom", "--network.file", valid}, name: "mynet", id: 4003, genesis: common.HexToHash("0x1111111111111111111111111111111111111111111111111111111111111111")},
+		{args: []string{"--network", "custom", "--network.file", unnamed}, name: "custom", id: 4003, genesis: common.HexToHash("0x1111111111111111111111111111111111111111111111111111111111111111")},
+		{args: []string{"--network", "custom"}, wantErr: true},
+		{args: []string{"--network", "custom", "--network.file", filepath.Join(dir, "missing.json")}, wantErr: true},
+		{args: []string{"--network", "custom", "--network.file", noID}, wantErr: true},
+		{args: []string{"--network", "custom", "--network.file", noGenesis}, wantErr: true},
+		{args: []string{"--network", "custom", "--network.file", noConfig}, wantErr: true},
+		{args: []string{"--network", "custom", "--network.file", broken}, wantErr: true},
+		{args: []string{"--network", "ropsten"}, wantErr: true},
+	}
+	for _, test := range tests {
+		ctx := newTestContext(t, []cli.Flag{networkFlag, networkFileFlag, networkIDFlag}, test.args...)
+		net, err := makeNetwork(ctx)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%v: expected error, got network %q", test.args, net.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.args, err)
+			continue
+		}
+		if net.Name != test.name || net.NetworkID != test.id || net.Genesis != test.genesis {
+			t.Errorf("%v: got network %q id %d genesis %x, want %q id %d genesis %x",
+				test.args, net.Name, net.NetworkID, net.Genesis, test.name, test.id, test.genesis)
+		}
+		if net.Config == nil {
+			t.Errorf("%v: missing fork schedule", test.args)
+		}
+	}
+}
+
+func TestMakeNetworkCopiesPreset(t *testing.T) {
+	ctx := newTestContext(t, []cli.Flag{networkFlag, networkFileFlag, networkIDFlag}, "--networkid", "1")
+	if _, err := makeNetwork(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if MainnetNetwork.NetworkID != 250 {
+		t.Fatalf("preset modified: network ID %d", MainnetNetwork.NetworkID)
+	}
+}
+
+func TestEthGenesis(t *testing.T) {
+	net := &network{Genesis: common.HexToHash("0x01"), EthGenesis: common.HexToHash("0x02")}
+	if got := ethGenesis(net, ""); got != net.EthGenesis {
+		t.Fatalf("got %x, want the configured eth genesis %x", got, net.EthGenesis)
+	}
+	net.EthGenesis = common.Hash{}
+	if got := ethGenesis(net, ""); got != (common.Hash{}) {
+		t.Fatalf("got %x, want no genesis without --nodeURL", got)
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 )
 
@@ -47,11 +48,25 @@ type nodeJSON struct {
 	LastResponse  time.Time `json:"lastResponse,omitempty"`
 	// This one tracks the time of our last attempt to contact the node.
 	LastCheck time.Time `json:"lastCheck,omitempty"`
+	// LastProbe is the time of the last RLPx probe, NextProbe the earliest
+	// time of the next one.
+	LastProbe time.Time `json:"lastProbe,omitempty"`
+	NextProbe time.Time `json:"nextProbe,omitempty"`
 
 	Info *clientInfo `json:"clientInfo,omitempty"`
 
 	ErrorReason int `json:"errorReason,omitempty"`
 	ErrorString string `json:"errorString,omitempty"`
+	// DisconnectReason is the reason sent by the node if it disconnected
+	// during the last probe.
+	DisconnectReason *p2p.DiscReason `json:"disconnectReason,omitempty"`
+
+	// Reachable reports whether the last probe succeeded, Latency is how
+	// long the node took to answer it, see probeTimings.probe.
+	Reachable bool          `json:"reachable,omitempty"`
+	Latency   time.Duration `json:"latency,omitempty"`
+	// Timings break the latency of the last probe down by stage.
+	Timings probeTimings `json:"timings"`
 }
 
 func loadNodesJSON(file string) nodeSet {
@@ -62,18 +77,16 @@ func loadNodesJSON(file string) nodeSet {
 	return nodes
 }
 
-func writeNodesJSON(file string, nodes nodeSet) {
+func writeNodesJSON(file string, nodes nodeSet) error {
 	nodesJSON, err := json.MarshalIndent(nodes, "", jsonIndent)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	if file == "-" {
-		os.Stdout.Write(nodesJSON)
-		return
-	}
-	if err := ioutil.WriteFile(file, nodesJSON, 0644); err != nil {
-		panic(err)
+		_, err = os.Stdout.Write(nodesJSON)
+		return err
 	}
+	return ioutil.WriteFile(file, nodesJSON, 0644)
 }
 
 // nodes returns the node records contained in the set.
@@ -89,6 +102,19 @@ func (ns nodeSet) nodes() []*enode.Node {
 	return result
 }
 
+// responsive returns the nodes which answered a discovery request since the
+// given time.
+func (ns nodeSet) responsive(since time.Time) []*enode.Node {
+	since = since.Truncate(time.Second)
+	var result []*enode.Node
+	for _, n := range ns {
+		if !n.LastResponse.Before(since) {
+			result = append(result, n.N)
+		}
+	}
+	return result
+}
+
 // add ensures the given nodes are present in the set.
 func (ns nodeSet) add(nodes ...*enode.Node) {
 	for _, n := range nodes {
@@ -10,6 +10,7 @@ import (
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/metrics/exp"
+	"github.com/ethereum/go-ethereum/metrics/prometheus"
 	"github.com/fjl/memsize/memsizeui"
 	"github.com/mattn/go-colorable"
 	"github.com/mattn/go-isatty"
@@ -73,6 +74,20 @@ var (
 		Name:  "trace",
 		Usage: "Write execution trace to the given file",
 	}
+	metricsFlag = cli.BoolFlag{
+		Name:  "metrics",
+		Usage: "Enable metrics collection and the Prometheus /metrics endpoint",
+	}
+	metricsAddrFlag = cli.StringFlag{
+		Name:  "metrics.addr",
+		Usage: "Metrics HTTP server listening interface",
+		Value: "127.0.0.1",
+	}
+	metricsPortFlag = cli.IntFlag{
+		Name:  "metrics.port",
+		Usage: "Metrics HTTP server listening port",
+		Value: 6061,
+	}
 )
 
 // Flags holds all command-line flags required for debugging.
@@ -89,6 +104,9 @@ var Flags = []cli.Flag{
 	blockprofilerateFlag,
 	cpuprofileFlag,
 	traceFlag,
+	metricsFlag,
+	metricsAddrFlag,
+	metricsPortFlag,
 }
 
 var glogger *log.GlogHandler
@@ -149,9 +167,28 @@ func Setup(ctx *cli.Context) error {
 		// It cannot be imported because it will cause a cyclical dependency.
 		StartPProf(address, !ctx.GlobalIsSet("metrics.addr"))
 	}
+
+	// metrics server, metrics.Enabled is already set from the command line
+	if ctx.GlobalBool(metricsFlag.Name) {
+		address := fmt.Sprintf("%s:%d", ctx.GlobalString(metricsAddrFlag.Name), ctx.GlobalInt(metricsPortFlag.Name))
+		StartMetrics(address)
+	}
 	return nil
 }
 
+// StartMetrics serves the metrics of the default registry in the Prometheus
+// format on /metrics.
+func StartMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheus.Handler(metrics.DefaultRegistry))
+	log.Info("Starting metrics server", "addr", fmt.Sprintf("http://%s/metrics", address))
+	go func() {
+		if err := http.ListenAndServe(address, mux); err != nil {
+			log.Error("Failure in running metrics server", "err", err)
+		}
+	}()
+}
+
 func StartPProf(address string, withMetrics bool) {
 	// Hook go-metrics into expvar on any /debug/metrics request, load all vars
 	// from the registry into expvar, and execute regular expvar handler.
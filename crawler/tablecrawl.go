@@ -0,0 +1,219 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+const (
+	// exhaustiveIdleDistances is the number of consecutive distances
+	// without new nodes after which the routing table of a node is
+	// considered enumerated. Buckets get exponentially emptier towards
+	// the node, so the rest of the table is almost always empty.
+	exhaustiveIdleDistances = 3
+	// v4MinDistance is the lowest distance queried over discv4. Nodes
+	// return the closest nodes to a target instead of a bucket, and the
+	// tables of geth based nodes keep all nodes below this distance in a
+	// single bucket.
+	v4MinDistance = 239
+)
+
+// exhaustiveDistances returns the log-distances whose buckets are enumerated
+// over the given protocol, farthest first.
+func exhaustiveDistances(protocol string) []uint {
+	min := 1
+	if protocol == "v4" {
+		min = v4MinDistance
+	}
+	dists := make([]uint, 0, 257-min)
+	for d := 256; d >= min; d-- {
+		dists = append(dists, uint(d))
+	}
+	return dists
+}
+
+// tableCrawl is an iterator which enumerates the routing tables of the seed
+// nodes and of every node found in them, until no new nodes appear.
+type tableCrawl struct {
+	protocol   string
+	distances  []uint
+	newQuerier func(*enode.Node) (tableQuerier, error)
+
+	out       chan *enode.Node
+	closed    chan struct{}
+	closeOnce sync.Once
+	cur       *enode.Node
+
+	mu        sync.Mutex
+	reported  map[enode.ID]int // number of routing tables containing a node
+	queried   int
+	responded int
+}
+
+// tableResult is the outcome of a routing table query.
+type tableResult struct {
+	n     *enode.Node
+	nodes []*enode.Node
+	err   error
+}
+
+// coverageEstimate tells how much of the network a crawl has found.
+type coverageEstimate struct {
+	Queried   int     // nodes whose routing table was queried
+	Responded int     // nodes which answered
+	Found     int     // distinct nodes in the routing tables
+	Estimated float64 // estimated number of nodes in the network
+}
+
+// Coverage is the share of the estimated network that was found.
+func (c coverageEstimate) Coverage() float64 {
+	if c.Estimated == 0 {
+		return 1
+	}
+	return float64(c.Found) / c.Estimated
+}
+
+// newTableCrawl starts a crawl querying the routing tables with the queriers
+// returned by newQuerier.
+func newTableCrawl(protocol string, seeds []*enode.Node, workers int, newQuerier func(*enode.Node) (tableQuerier, error)) *tableCrawl {
+	c := &tableCrawl{
+		protocol:   protocol,
+		distances:  exhaustiveDistances(protocol),
+		newQuerier: newQuerier,
+		out:        make(chan *enode.Node),
+		closed:     make(chan struct{}),
+		reported:   make(map[enode.ID]int),
+	}
+	go c.loop(seeds, workers)
+	return c
+}
+
+// loop queries the routing tables of up to workers nodes at a time and hands
+// every node it hasn't seen before to Next.
+func (c *tableCrawl) loop(seeds []*enode.Node, workers int) {
+	defer close(c.out)
+
+	var (
+		queue   []*enode.Node // nodes to query
+		pending []*enode.Node // nodes not yet returned by Next
+		known   = make(map[enode.ID]struct{})
+		// Buffered, so queries in flight when the crawl is closed
+		// don't block.
+		results = make(chan tableResult, workers)
+		running int
+	)
+	add := func(n *enode.Node) {
+		if _, ok := known[n.ID()]; ok || n.IP() == nil || n.UDP() == 0 {
+			return
+		}
+		known[n.ID()] = struct{}{}
+		queue = append(queue, n)
+		pending = append(pending, n)
+	}
+	for _, n := range seeds {
+		add(n)
+	}
+
+	for len(queue) > 0 || len(pending) > 0 || running > 0 {
+		for ; running < workers && len(queue) > 0; running++ {
+			go c.query(queue[0], results)
+			queue[0] = nil
+			queue = queue[1:]
+		}
+		var (
+			outCh chan *enode.Node
+			next  *enode.Node
+		)
+		if len(pending) > 0 {
+			outCh, next = c.out, pending[0]
+		}
+		select {
+		case outCh <- next:
+			pending[0] = nil
+			pending = pending[1:]
+		case r := <-results:
+			running--
+			c.record(r)
+			for _, n := range r.nodes {
+				add(n)
+			}
+		case <-c.closed:
+			return
+		}
+	}
+	log.Debug("Routing table crawl exhausted", "protocol", c.protocol, "nodes", len(known))
+}
+
+func (c *tableCrawl) query(n *enode.Node, results chan<- tableResult) {
+	var nodes []*enode.Node
+	q, err := c.newQuerier(n)
+	if err == nil {
+		nodes, err = queryTable(q, n, c.distances, exhaustiveIdleDistances)
+		q.close()
+	}
+	if err != nil {
+		log.Debug("Routing table query failed", "id", n.ID(), "protocol", c.protocol, "nodes", len(nodes), "err", err)
+	}
+	results <- tableResult{n, nodes, err}
+}
+
+func (c *tableCrawl) record(r tableResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.queried++
+	if r.err == nil || len(r.nodes) > 0 {
+		c.responded++
+	}
+	for _, n := range r.nodes {
+		c.reported[n.ID()]++
+	}
+}
+
+// coverage estimates the size of the network from how many routing tables
+// contained each node, using the bias-corrected Chao1 estimator: many nodes
+// found in a single table hint at many nodes found in none.
+func (c *tableCrawl) coverage() coverageEstimate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var f1, f2 int
+	for _, count := range c.reported {
+		switch count {
+		case 1:
+			f1++
+		case 2:
+			f2++
+		}
+	}
+	found := len(c.reported)
+	return coverageEstimate{
+		Queried:   c.queried,
+		Responded: c.responded,
+		Found:     found,
+		Estimated: float64(found) + float64(f1*(f1-1))/float64(2*(f2+1)),
+	}
+}
+
+func (c *tableCrawl) Next() bool {
+	select {
+	case n, ok := <-c.out:
+		if !ok {
+			return false
+		}
+		c.cur = n
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+func (c *tableCrawl) Node() *enode.Node {
+	return c.cur
+}
+
+func (c *tableCrawl) Close() {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
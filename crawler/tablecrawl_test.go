@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// testQuerier serves a fixed routing table by distance.
+type testQuerier struct {
+	table   map[uint][]*enode.Node
+	err     error // returned for distances missing from the table
+	queried []uint
+}
+
+func (q *testQuerier) findnode(dist uint) ([]*enode.Node, error) {
+	q.queried = append(q.queried, dist)
+	if nodes, ok := q.table[dist]; ok {
+		return nodes, nil
+	}
+	return nil, q.err
+}
+
+func (q *testQuerier) close() {}
+
+func TestExhaustiveDistances(t *testing.T) {
+	for _, test := range []struct {
+		protocol      string
+		first, last   uint
+		wantDistances int
+	}{
+		{"v4", 256, v4MinDistance, 256 - v4MinDistance + 1},
+		{"v5", 256, 1, 256},
+	} {
+		dists := exhaustiveDistances(test.protocol)
+		if len(dists) != test.wantDistances || dists[0] != test.first || dists[len(dists)-1] != test.last {
+			t.Errorf("%s: got %d distances from %d to %d", test.protocol, len(dists), dists[0], dists[len(dists)-1])
+		}
+	}
+}
+
+func TestQueryTable(t *testing.T) {
+	var (
+		self       = newTestNode(t)
+		a, b, c, d = newTestNode(t), newTestNode(t), newTestNode(t), newTestNode(t)
+		table      = map[uint][]*enode.Node{
+			256: {a, b},
+			255: {b, self}, // duplicates and the node itself are skipped
+			254: {c},
+			253: {},
+			252: {a},
+			251: {},
+			250: {d},
+		}
+		distances = []uint{256, 255, 254, 253, 252, 251, 250, 249}
+	)
+	tests := []struct {
+		name    string
+		idle    int
+		err     error
+		want    []*enode.Node
+		queried []uint
+	}{
+		{name: "idle cut-off", idle: 3, want: []*enode.Node{a, b, c}, queried: distances[:6]},
+		{name: "longer idle run", idle: 4, want: []*enode.Node{a, b, c, d}, queried: distances},
+		{name: "without cut-off", want: []*enode.Node{a, b, c, d}, queried: distances},
+		{name: "error", err: errors.New("timeout"), want: []*enode.Node{a, b, c, d}, queried: distances},
+	}
+	for _, test := range tests {
+		q := &testQuerier{table: table, err: test.err}
+		found, err := queryTable(q, self, distances, test.idle)
+		if err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+		if !reflect.DeepEqual(found, test.want) {
+			t.Errorf("%s: found %d nodes, want %d", test.name, len(found), len(test.want))
+		}
+		if !reflect.DeepEqual(q.queried, test.queried) {
+			t.Errorf("%s: queried distances %v, want %v", test.name, q.queried, test.queried)
+		}
+	}
+}
+
+func TestTableCrawl(t *testing.T) {
+	a, b, c, d := newTestNode(t), newTestNode(t), newTestNode(t), newTestNode(t)
+	unreachable := errors.New("unreachable")
+	tables := map[enode.ID]*testQuerier{
+		a.ID(): {table: map[uint][]*enode.Node{256: {b, c}}},
+		b.ID(): {table: map[uint][]*enode.Node{256: {c}, 255: {d}}},
+		c.ID(): {table: map[uint][]*enode.Node{256: {a, d}}},
+		d.ID(): {err: unreachable},
+	}
+	tc := newTableCrawl("v4", []*enode.Node{a}, 2, func(n *enode.Node) (tableQuerier, error) {
+		return tables[n.ID()], nil
+	})
+	defer tc.Close()
+
+	found := make(map[enode.ID]bool)
+	for tc.Next() {
+		found[tc.Node().ID()] = true
+	}
+	if len(found) != 4 {
+		t.Errorf("crawl returned %d nodes, want 4", len(found))
+	}
+
+	// a and b are in one table, c and d in two.
+	cov := tc.coverage()
+	want := coverageEstimate{Queried: 4, Responded: 3, Found: 4, Estimated: 4 + 2.0/6}
+	if cov.Queried != want.Queried || cov.Responded != want.Responded || cov.Found != want.Found || math.Abs(cov.Estimated-want.Estimated) > 1e-9 {
+		t.Errorf("got coverage %+v, want %+v", cov, want)
+	}
+	if c := cov.Coverage(); math.Abs(c-12.0/13) > 1e-9 {
+		t.Errorf("got coverage %f, want %f", c, 12.0/13)
+	}
+}
+
+func TestCoverageEstimate(t *testing.T) {
+	tests := []struct {
+		reported  []int
+		estimated float64
+	}{
+		{reported: nil, estimated: 0},
+		// Every node in many tables, nothing is missing.
+		{reported: []int{3, 4, 5}, estimated: 3},
+		// Only singletons: f1*(f1-1)/2 nodes are assumed missing.
+		{reported: []int{1, 1, 1, 1}, estimated: 4 + 12.0/2},
+		{reported: []int{1, 1, 1, 2, 2, 5}, estimated: 6 + 6.0/6},
+	}
+	for _, test := range tests {
+		c := &tableCrawl{reported: make(map[enode.ID]int)}
+		for i, count := range test.reported {
+			c.reported[enode.ID{byte(i)}] = count
+		}
+		cov := c.coverage()
+		if cov.Found != len(test.reported) || math.Abs(cov.Estimated-test.estimated) > 1e-9 {
+			t.Errorf("%v: got %d found, %f estimated, want %d and %f", test.reported, cov.Found, cov.Estimated, len(test.reported), test.estimated)
+		}
+	}
+	if c := (coverageEstimate{}).Coverage(); c != 1 {
+		t.Errorf("empty crawl has coverage %f, want 1", c)
+	}
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/discover/v4wire"
+	"github.com/ethereum/go-ethereum/p2p/discover/v5wire"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+const (
+	// topologyBucketSize is the number of nodes a FINDNODE query returns
+	// at most.
+	topologyBucketSize = 16
+	// maxTargetAttempts bounds the search for a discv4 target at a given
+	// distance, which takes about 2^(257-distance) attempts.
+	maxTargetAttempts = 1 << 21
+)
+
+// topologyEdge means that From returned To from its routing table.
+type topologyEdge struct {
+	From, To enode.ID
+	Protocol string // "v4" or "v5"
+	Distance int    // log-distance between From and To
+}
+
+// topologyConfig holds the tunables of the topology crawl.
+type topologyConfig struct {
+	Buckets int           // number of log-distances queried, counting down from 256
+	Workers int           // nodes queried concurrently
+	Timeout time.Duration // response timeout
+}
+
+// distances returns the log-distances queried, farthest first.
+func (cfg topologyConfig) distances() []uint {
+	dists := make([]uint, 0, cfg.Buckets)
+	for d := 256; d > 256-cfg.Buckets && d > 0; d-- {
+		dists = append(dists, uint(d))
+	}
+	return dists
+}
+
+// topologyJob is a node whose routing table is queried.
+type topologyJob struct {
+	n        *enode.Node
+	protocol string
+}
+
+// crawlTopology queries the routing tables of the given nodes over discv4
+// and discv5 and returns the edges of the resulting graph. Queries which
+// haven't started when stop is closed are skipped.
+func crawlTopology(cfg topologyConfig, v4, v5 []*enode.Node, stop <-chan struct{}) []topologyEdge {
+	var (
+		jobs  = make(chan topologyJob)
+		edges []topologyEdge
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				found, err := queryRoutingTable(job.n, job.protocol, cfg.distances(), cfg.Timeout, 0)
+				if err != nil {
+					log.Debug("Topology query failed", "id", job.n.ID(), "protocol", job.protocol, "nodes", len(found), "err", err)
+				}
+				mu.Lock()
+				edges = append(edges, makeEdges(job.n.ID(), job.protocol, found)...)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	started := time.Now()
+	all := make([]topologyJob, 0, len(v4)+len(v5))
+	for _, n := range v4 {
+		all = append(all, topologyJob{n, "v4"})
+	}
+	for _, n := range v5 {
+		all = append(all, topologyJob{n, "v5"})
+	}
+loop:
+	for _, job := range all {
+		select {
+		case jobs <- job:
+		case <-stop:
+			break loop
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	log.Info("Topology crawl done", "nodes", len(all), "edges", len(edges), "duration", time.Since(started))
+	topologyEdgesGauge.Update(int64(len(edges)))
+	return edges
+}
+
+// topologyCrawler runs the topology crawls in the background, so they don't
+// delay the next round. A round whose crawl would overlap the previous one
+// skips it.
+type topologyCrawler struct {
+	cfg       topologyConfig
+	db        *sql.DB
+	crawlerID string
+	stop      <-chan struct{}
+
+	mu      sync.Mutex
+	running bool
+	wg      sync.WaitGroup
+}
+
+func newTopologyCrawler(cfg topologyConfig, db *sql.DB, crawlerID string, stop <-chan struct{}) *topologyCrawler {
+	return &topologyCrawler{cfg: cfg, db: db, crawlerID: crawlerID, stop: stop}
+}
+
+// start crawls the topology of the given nodes and stores the edges. It
+// returns false if the previous crawl is still running.
+func (t *topologyCrawler) start(v4, v5 []*enode.Node) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.running {
+		log.Warn("Skipping topology crawl, the previous one is still running")
+		return false
+	}
+	t.running = true
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		edges := crawlTopology(t.cfg, v4, v5, t.stop)
+		if err := updateEdges(t.db, t.crawlerID, edges); err != nil {
+			log.Error("Failed to store topology", "err", err)
+		}
+		t.mu.Lock()
+		t.running = false
+		t.mu.Unlock()
+	}()
+	return true
+}
+
+// wait blocks until the running crawl, if any, is done.
+func (t *topologyCrawler) wait() {
+	t.wg.Wait()
+}
+
+// makeEdges turns the nodes returned by from into edges.
+func makeEdges(from enode.ID, protocol string, nodes []*enode.Node) []topologyEdge {
+	edges := make([]topologyEdge, 0, len(nodes))
+	for _, n := range nodes {
+		edges = append(edges, topologyEdge{From: from, To: n.ID(), Protocol: protocol, Distance: enode.LogDist(from, n.ID())})
+	}
+	return edges
+}
+
+// tableQuerier sends FINDNODE queries to a single node.
+type tableQuerier interface {
+	// findnode returns the nodes the node knows at the given log-distance.
+	findnode(dist uint) ([]*enode.Node, error)
+	close()
+}
+
+// newTableQuerier returns a querier for n over the given protocol.
+func newTableQuerier(n *enode.Node, protocol string, timeout time.Duration) (tableQuerier, error) {
+	if protocol == "v4" {
+		return newV4Querier(n, timeout)
+	}
+	return newV5Querier(n, timeout)
+}
+
+// queryRoutingTable returns the nodes in the routing table of n at the given
+// distances, without duplicates. If idle is positive, the query ends once
+// that many consecutive distances returned no new nodes. On error, the nodes
+// found until then are returned.
+func queryRoutingTable(n *enode.Node, protocol string, distances []uint, timeout time.Duration, idle int) ([]*enode.Node, error) {
+	q, err := newTableQuerier(n, protocol, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer q.close()
+	return queryTable(q, n, distances, idle)
+}
+
+// queryTable is queryRoutingTable over an open querier.
+func queryTable(q tableQuerier, n *enode.Node, distances []uint, idle int) ([]*enode.Node, error) {
+	var (
+		found   []*enode.Node
+		seen    = make(map[enode.ID]struct{})
+		idleRun int
+	)
+	for _, d := range distances {
+		nodes, err := q.findnode(d)
+		added := 0
+		for _, rn := range nodes {
+			if _, ok := seen[rn.ID()]; ok || rn.ID() == n.ID() {
+				continue
+			}
+			seen[rn.ID()] = struct{}{}
+			found = append(found, rn)
+			added++
+		}
+		if err != nil {
+			return found, err
+		}
+		if added > 0 {
+			idleRun = 0
+		} else if idleRun++; idle > 0 && idleRun >= idle {
+			break
+		}
+	}
+	return found, nil
+}
+
+// v4Querier sends FINDNODE queries to a single discv4 node. Every querier
+// uses its own socket and key, so the responses of concurrent queries
+// can't mix.
+type v4Querier struct {
+	key     *ecdsa.PrivateKey
+	conn    net.PacketConn
+	remote  *enode.Node
+	addr    *net.UDPAddr
+	timeout time.Duration
+	rand    *rand.Rand
+}
+
+func newV4Querier(n *enode.Node, timeout time.Duration) (*v4Querier, error) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	q := &v4Querier{
+		key:     key,
+		conn:    conn,
+		remote:  n,
+		addr:    &net.UDPAddr{IP: n.IP(), Port: n.UDP()},
+		timeout: timeout,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	// Nodes only answer FINDNODE after the endpoint proof.
+	if err := q.bond(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *v4Querier) close() {
+	q.conn.Close()
+}
+
+// bond performs the endpoint proof: the node has to answer our PING, and
+// we answer its PING if it sends one.
+func (q *v4Querier) bond() error {
+	hash, err := q.send(&v4wire.Ping{
+		Version:    4,
+		From:       q.localEndpoint(),
+		To:         v4wire.NewEndpoint(q.addr, 0),
+		Expiration: expiration(),
+	})
+	if err != nil {
+		return err
+	}
+	var pong, pinged bool
+	deadline := time.Now().Add(2 * q.timeout)
+	for !pong || !pinged {
+		p, _, err := q.read(deadline)
+		if err != nil {
+			if pong && isTimeout(err) {
+				// The node still knows us from a previous bond.
+				return nil
+			}
+			return err
+		}
+		if p, ok := p.(*v4wire.Pong); ok && bytes.Equal(p.ReplyTok, hash) {
+			pong = true
+		}
+		if _, ok := p.(*v4wire.Ping); ok {
+			pinged = true
+		}
+	}
+	return nil
+}
+
+// findnode queries the nodes closest to a target at the given distance. The
+// node sends them in NEIGHBORS packets of up to v4wire.MaxNeighbors nodes, a
+// shorter packet is the last one. Distances without a target return no nodes.
+func (q *v4Querier) findnode(dist uint) ([]*enode.Node, error) {
+	target, ok := q.target(dist)
+	if !ok {
+		return nil, nil
+	}
+	if _, err := q.send(&v4wire.Findnode{Target: target, Expiration: expiration()}); err != nil {
+		return nil, err
+	}
+	var nodes []*enode.Node
+	deadline := time.Now().Add(q.timeout)
+	for len(nodes) < topologyBucketSize {
+		p, _, err := q.read(deadline)
+		if err != nil {
+			if isTimeout(err) {
+				break
+			}
+			return nodes, err
+		}
+		if p, ok := p.(*v4wire.Neighbors); ok {
+			for _, rn := range p.Nodes {
+				key, err := v4wire.DecodePubkey(crypto.S256(), rn.ID)
+				if err != nil {
+					continue
+				}
+				nodes = append(nodes, enode.NewV4(key, rn.IP, int(rn.TCP), int(rn.UDP)))
+			}
+			if len(p.Nodes) < v4wire.MaxNeighbors {
+				break
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// target returns a FINDNODE target whose hash is at the given log-distance
+// from the node. Targets don't need to be valid public keys.
+func (q *v4Querier) target(dist uint) (v4wire.Pubkey, bool) {
+	var target v4wire.Pubkey
+	for i := 0; i < maxTargetAttempts; i++ {
+		q.rand.Read(target[:])
+		if enode.LogDist(q.remote.ID(), target.ID()) == int(dist) {
+			return target, true
+		}
+	}
+	return target, false
+}
+
+func (q *v4Querier) send(p v4wire.Packet) ([]byte, error) {
+	packet, hash, err := v4wire.Encode(q.key, p)
+	if err != nil {
+		return nil, err
+	}
+	_, err = q.conn.WriteTo(packet, q.addr)
+	return hash, err
+}
+
+// read returns the next packet of the node. PINGs are answered right away.
+func (q *v4Querier) read(deadline time.Time) (v4wire.Packet, []byte, error) {
+	buf := make([]byte, 1280)
+	for {
+		if err := q.conn.SetReadDeadline(deadline); err != nil {
+			return nil, nil, err
+		}
+		n, from, err := q.conn.ReadFrom(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		p, _, hash, err := v4wire.Decode(buf[:n])
+		if err != nil {
+			continue
+		}
+		if ping, ok := p.(*v4wire.Ping); ok {
+			_, err := q.send(&v4wire.Pong{
+				To:         v4wire.NewEndpoint(from.(*net.UDPAddr), ping.From.TCP),
+				ReplyTok:   hash,
+				Expiration: expiration(),
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return p, hash, nil
+	}
+}
+
+func (q *v4Querier) localEndpoint() v4wire.Endpoint {
+	addr := q.conn.LocalAddr().(*net.UDPAddr)
+	return v4wire.Endpoint{IP: addr.IP.To4(), UDP: uint16(addr.Port)}
+}
+
+func expiration() uint64 {
+	return uint64(time.Now().Add(20 * time.Second).Unix())
+}
+
+// v5Querier sends FINDNODE queries to a single discv5 node.
+type v5Querier struct {
+	db        *enode.DB
+	localNode *enode.LocalNode
+	codec     *v5wire.Codec
+	conn      net.PacketConn
+	remote    *enode.Node
+	addr      *net.UDPAddr
+	timeout   time.Duration
+	reqID     uint32
+}
+
+func newV5Querier(n *enode.Node, timeout time.Duration) (*v5Querier, error) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	db, err := enode.OpenDB("")
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	ln := enode.NewLocalNode(db, key)
+	ln.SetFallbackUDP(conn.LocalAddr().(*net.UDPAddr).Port)
+	return &v5Querier{
+		db:        db,
+		localNode: ln,
+		codec:     v5wire.NewCodec(ln, key, mclock.System{}),
+		conn:      conn,
+		remote:    n,
+		addr:      &net.UDPAddr{IP: n.IP(), Port: n.UDP()},
+		timeout:   timeout,
+	}, nil
+}
+
+func (q *v5Querier) close() {
+	q.conn.Close()
+	q.db.Close()
+}
+
+// findnode queries the nodes at the given distance. The first query of a
+// session is answered with a WHOAREYOU challenge, which is handled here.
+func (q *v5Querier) findnode(dist uint) ([]*enode.Node, error) {
+	req := &v5wire.Findnode{ReqID: q.nextReqID(), Distances: []uint{dist}}
+	nonce, err := q.write(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		nodes    []*enode.Node
+		received int
+		total    = 1
+		deadline = time.Now().Add(q.timeout)
+	)
+	for received < total {
+		p, err := q.read(deadline)
+		if err != nil {
+			if isTimeout(err) {
+				break
+			}
+			return nodes, err
+		}
+		switch p := p.(type) {
+		case *v5wire.Whoareyou:
+			if p.Nonce != nonce {
+				continue
+			}
+			p.Node = q.remote
+			if _, err := q.write(req, p); err != nil {
+				return nodes, err
+			}
+		case *v5wire.Ping:
+			if _, err := q.write(&v5wire.Pong{ReqID: p.ReqID, ENRSeq: q.localNode.Seq()}, nil); err != nil {
+				return nodes, err
+			}
+		case *v5wire.Nodes:
+			if !bytes.Equal(p.ReqID, req.ReqID) {
+				continue
+			}
+			received++
+			if int(p.Total) > total {
+				total = int(p.Total)
+			}
+			for _, r := range p.Nodes {
+				n, err := enode.New(enode.ValidSchemes, r)
+				if err != nil {
+					continue
+				}
+				nodes = append(nodes, n)
+			}
+		}
+	}
+	return nodes, nil
+}
+
+func (q *v5Querier) nextReqID() []byte {
+	id := make([]byte, 4)
+	q.reqID++
+	binary.BigEndian.PutUint32(id, q.reqID)
+	return id
+}
+
+func (q *v5Querier) write(p v5wire.Packet, challenge *v5wire.Whoareyou) (v5wire.Nonce, error) {
+	packet, nonce, err := q.codec.Encode(q.remote.ID(), q.addr.String(), p, challenge)
+	if err != nil {
+		return nonce, fmt.Errorf("can't encode %v packet: %v", p.Name(), err)
+	}
+	_, err = q.conn.WriteTo(packet, q.addr)
+	return nonce, err
+}
+
+// read returns the next packet of the node, skipping undecodable ones.
+func (q *v5Querier) read(deadline time.Time) (v5wire.Packet, error) {
+	buf := make([]byte, 1280)
+	for {
+		if err := q.conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		n, from, err := q.conn.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		_, _, p, err := q.codec.Decode(buf[:n], from.String())
+		if err != nil {
+			continue
+		}
+		return p, nil
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/discover/v4wire"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+func testTopology() *topologyGraph {
+	return &topologyGraph{
+		Nodes: []topologyNode{
+			{ID: "aa", Client: "go-opera", Country: "Germany"},
+			{ID: "bb", Client: `<"odd" & client>`},
+		},
+		Edges: []topologyEdgeRow{
+			{From: "aa", To: "bb", Protocol: "v4", Distance: 256},
+		},
+	}
+}
+
+func TestWriteGraphML(t *testing.T) {
+	var buf bytes.Buffer
+	writeGraphML(&buf, testTopology())
+
+	var doc struct {
+		Keys []struct {
+			ID string `xml:"id,attr"`
+		} `xml:"key"`
+		Graph struct {
+			Nodes []struct {
+				ID   string `xml:"id,attr"`
+				Data []struct {
+					Key   string `xml:"key,attr"`
+					Value string `xml:",chardata"`
+				} `xml:"data"`
+			} `xml:"node"`
+			Edges []struct {
+				Source string `xml:"source,attr"`
+				Target string `xml:"target,attr"`
+				Data   []struct {
+					Key   string `xml:"key,attr"`
+					Value string `xml:",chardata"`
+				} `xml:"data"`
+			} `xml:"edge"`
+		} `xml:"graph"`
+	}
+	if err := xml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid GraphML: %v\n%s", err, buf.String())
+	}
+	if len(doc.Keys) != 4 {
+		t.Errorf("got %d keys, want 4", len(doc.Keys))
+	}
+	if len(doc.Graph.Nodes) != 2 || len(doc.Graph.Edges) != 1 {
+		t.Fatalf("got %d nodes and %d edges, want 2 and 1", len(doc.Graph.Nodes), len(doc.Graph.Edges))
+	}
+	if n := doc.Graph.Nodes[1]; n.ID != "bb" || n.Data[0].Key != "client" || n.Data[0].Value != `<"odd" & client>` {
+		t.Errorf("got node %+v", n)
+	}
+	if n := doc.Graph.Nodes[0]; n.Data[1].Key != "country" || n.Data[1].Value != "Germany" {
+		t.Errorf("got node %+v", n)
+	}
+	e := doc.Graph.Edges[0]
+	if e.Source != "aa" || e.Target != "bb" || e.Data[0].Value != "v4" || e.Data[1].Value != "256" {
+		t.Errorf("got edge %+v", e)
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	var buf bytes.Buffer
+	writeDOT(&buf, testTopology())
+
+	want := `digraph topology {
+  "aa" [client="go-opera", country="Germany"];
+  "bb" [client="<\"odd\" & client>", country=""];
+  "aa" -> "bb" [protocol="v4", distance=256];
+}
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestReadTopology(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	a, b, c, old := newTestNode(t).ID(), newTestNode(t).ID(), newTestNode(t).ID(), newTestNode(t).ID()
+	if _, err := db.Exec(`INSERT INTO nodes(ID, Now, ClientType, Country) values(?, '', 'go-opera', 'Germany')`, a.String()); err != nil {
+		t.Fatal(err)
+	}
+	edges := []topologyEdge{
+		{From: a, To: b, Protocol: "v4", Distance: 255},
+		{From: a, To: b, Protocol: "v5", Distance: 255},
+		{From: b, To: c, Protocol: "v5", Distance: 256},
+		{From: old, To: a, Protocol: "v4", Distance: 256},
+	}
+	if err := updateEdges(db, "test", edges); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE edges SET LastSeen = ? WHERE FromID = ?`, time.Now().Add(-48*time.Hour).Unix(), old.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := readTopology(db, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Edges) != 3 {
+		t.Fatalf("got %d edges, want 3: %+v", len(g.Edges), g.Edges)
+	}
+	for i := 1; i < len(g.Edges); i++ {
+		p, e := g.Edges[i-1], g.Edges[i]
+		if p.From > e.From || (p.From == e.From && p.To > e.To) || (p.From == e.From && p.To == e.To && p.Protocol >= e.Protocol) {
+			t.Errorf("edges not sorted: %+v", g.Edges)
+		}
+	}
+	if len(g.Nodes) != 3 {
+		t.Fatalf("got %d nodes, want 3: %+v", len(g.Nodes), g.Nodes)
+	}
+	for i, n := range g.Nodes {
+		if i > 0 && g.Nodes[i-1].ID >= n.ID {
+			t.Errorf("nodes not sorted: %+v", g.Nodes)
+		}
+		switch n.ID {
+		case a.String():
+			if n.Client != "go-opera" || n.Country != "Germany" {
+				t.Errorf("got node %+v", n)
+			}
+		case b.String(), c.String():
+			if n.Client != "" || n.Country != "" {
+				t.Errorf("unknown node has details %+v", n)
+			}
+		default:
+			t.Errorf("unexpected node %s", n.ID)
+		}
+	}
+}
+
+// TestV4FindnodeLastPacket checks that findnode returns on the last NEIGHBORS
+// packet instead of waiting for the timeout.
+func TestV4FindnodeLastPacket(t *testing.T) {
+	peerKey, _ := crypto.GenerateKey()
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	remote := enode.NewV4(&peerKey.PublicKey, []byte{127, 0, 0, 1}, 0, peer.LocalAddr().(*net.UDPAddr).Port)
+
+	// The peer answers every FINDNODE with the number of nodes read from
+	// sizes, split into packets like geth does.
+	sizes := make(chan int, 1)
+	go func() {
+		buf := make([]byte, 1280)
+		for {
+			n, from, err := peer.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			p, _, _, err := v4wire.Decode(buf[:n])
+			if err != nil {
+				continue
+			}
+			if _, ok := p.(*v4wire.Findnode); !ok {
+				continue
+			}
+			var (
+				size = <-sizes
+				resp = v4wire.Neighbors{Expiration: expiration()}
+				sent bool
+			)
+			for i := 0; i < size; i++ {
+				key, _ := crypto.GenerateKey()
+				resp.Nodes = append(resp.Nodes, v4wire.Node{ID: v4wire.EncodePubkey(&key.PublicKey), IP: net.IP{127, 0, 0, 1}, UDP: 30303, TCP: 30303})
+				if len(resp.Nodes) == v4wire.MaxNeighbors {
+					packet, _, _ := v4wire.Encode(peerKey, &resp)
+					peer.WriteTo(packet, from)
+					resp.Nodes, sent = nil, true
+				}
+			}
+			if len(resp.Nodes) > 0 || !sent {
+				packet, _, _ := v4wire.Encode(peerKey, &resp)
+				peer.WriteTo(packet, from)
+			}
+		}
+	}()
+
+	key, _ := crypto.GenerateKey()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const timeout = 2 * time.Second
+	q := &v4Querier{
+		key:     key,
+		conn:    conn,
+		remote:  remote,
+		addr:    &net.UDPAddr{IP: remote.IP(), Port: remote.UDP()},
+		timeout: timeout,
+		rand:    rand.New(rand.NewSource(1)),
+	}
+	defer q.close()
+
+	for _, size := range []int{0, 3, 13, 16} {
+		sizes <- size
+		start := time.Now()
+		nodes, err := q.findnode(256)
+		if err != nil {
+			t.Fatalf("%d nodes: %v", size, err)
+		}
+		if len(nodes) != size {
+			t.Errorf("got %d nodes, want %d", len(nodes), size)
+		}
+		if elapsed := time.Since(start); elapsed >= timeout/2 {
+			t.Errorf("%d nodes: findnode took %v", size, elapsed)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+var (
+	topologyCommand = cli.Command{
+		Name:   "topology",
+		Usage:  "Export the discovery topology recorded with crawl --topology",
+		Action: exportTopology,
+		Flags: []cli.Flag{
+			tableNameFlag,
+			topologyFormatFlag,
+			topologySinceFlag,
+		},
+	}
+	topologyFormatFlag = cli.StringFlag{
+		Name:  "format",
+		Usage: "Output format (graphml or dot)",
+		Value: "graphml",
+	}
+	topologySinceFlag = cli.DurationFlag{
+		Name:  "since",
+		Usage: "Only export edges seen within this duration",
+		Value: 24 * time.Hour,
+	}
+)
+
+// topologyNode is a vertex of the exported graph.
+type topologyNode struct {
+	ID      string
+	Client  string
+	Country string
+}
+
+// topologyGraph is the discovery topology read from the database.
+type topologyGraph struct {
+	Nodes []topologyNode
+	Edges []topologyEdgeRow
+}
+
+type topologyEdgeRow struct {
+	From, To string
+	Protocol string
+	Distance int
+}
+
+func exportTopology(ctx *cli.Context) error {
+	if !ctx.IsSet(tableNameFlag.Name) {
+		return fmt.Errorf("missing --%s", tableNameFlag.Name)
+	}
+	format := ctx.String(topologyFormatFlag.Name)
+	if format != "graphml" && format != "dot" {
+		return fmt.Errorf("invalid format %q", format)
+	}
+	db, err := sql.Open("sqlite3", ctx.String(tableNameFlag.Name))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := migrateDB(db); err != nil {
+		return err
+	}
+
+	g, err := readTopology(db, time.Now().Add(-ctx.Duration(topologySinceFlag.Name)))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if format == "dot" {
+		writeDOT(w, g)
+	} else {
+		writeGraphML(w, g)
+	}
+	return w.Flush()
+}
+
+// readTopology returns the edges seen since the given time and the nodes
+// they connect.
+func readTopology(db *sql.DB, since time.Time) (*topologyGraph, error) {
+	rows, err := db.Query(`SELECT FromID, ToID, Protocol, IFNULL(Distance, 0) FROM edges
+		WHERE LastSeen >= ? ORDER BY FromID, ToID, Protocol`, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		g   topologyGraph
+		ids = make(map[string]struct{})
+	)
+	for rows.Next() {
+		var e topologyEdgeRow
+		if err := rows.Scan(&e.From, &e.To, &e.Protocol, &e.Distance); err != nil {
+			return nil, err
+		}
+		ids[e.From], ids[e.To] = struct{}{}, struct{}{}
+		g.Edges = append(g.Edges, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stmt, err := db.Prepare(`SELECT IFNULL(ClientType, ''), IFNULL(Country, '') FROM nodes WHERE ID = ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	for id := range ids {
+		n := topologyNode{ID: id}
+		err := stmt.QueryRow(id).Scan(&n.Client, &n.Country)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		g.Nodes = append(g.Nodes, n)
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].ID < g.Nodes[j].ID })
+	return &g, nil
+}
+
+func writeGraphML(w io.Writer, g *topologyGraph) {
+	fmt.Fprintln(w, xml.Header+`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">`)
+	fmt.Fprintln(w, `  <key id="client" for="node" attr.name="client" attr.type="string"/>`)
+	fmt.Fprintln(w, `  <key id="country" for="node" attr.name="country" attr.type="string"/>`)
+	fmt.Fprintln(w, `  <key id="protocol" for="edge" attr.name="protocol" attr.type="string"/>`)
+	fmt.Fprintln(w, `  <key id="distance" for="edge" attr.name="distance" attr.type="int"/>`)
+	fmt.Fprintln(w, `  <graph id="topology" edgedefault="directed">`)
+	for _, n := range g.Nodes {
+		fmt.Fprintf(w, "    <node id=%q>\n", n.ID)
+		fmt.Fprintf(w, "      <data key=\"client\">%s</data>\n", escapeXML(n.Client))
+		fmt.Fprintf(w, "      <data key=\"country\">%s</data>\n", escapeXML(n.Country))
+		fmt.Fprintln(w, "    </node>")
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(w, "    <edge source=%q target=%q>\n", e.From, e.To)
+		fmt.Fprintf(w, "      <data key=\"protocol\">%s</data>\n", escapeXML(e.Protocol))
+		fmt.Fprintf(w, "      <data key=\"distance\">%d</data>\n", e.Distance)
+		fmt.Fprintln(w, "    </edge>")
+	}
+	fmt.Fprintln(w, "  </graph>")
+	fmt.Fprintln(w, "</graphml>")
+}
+
+func writeDOT(w io.Writer, g *topologyGraph) {
+	fmt.Fprintln(w, "digraph topology {")
+	for _, n := range g.Nodes {
+		fmt.Fprintf(w, "  %s [client=%s, country=%s];\n", strconv.Quote(n.ID), strconv.Quote(n.Client), strconv.Quote(n.Country))
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(w, "  %s -> %s [protocol=%s, distance=%d];\n", strconv.Quote(e.From), strconv.Quote(e.To), strconv.Quote(e.Protocol), e.Distance)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func escapeXML(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}